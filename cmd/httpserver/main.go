@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"httpFromTCP/internal/fileserver"
 	"httpFromTCP/internal/headers"
 	"httpFromTCP/internal/request"
 	"httpFromTCP/internal/response"
+	"httpFromTCP/internal/router"
 	"httpFromTCP/internal/server"
 	"io"
 	"log"
@@ -11,9 +14,16 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 const port = 42069
+const shutdownTimeout = 10 * time.Second
+const headerReadTimeout = 10 * time.Second
+const bodyReadTimeout = 30 * time.Second
+const idleTimeout = 2 * time.Minute
+const assetsDir = "assets"
+const videoFile = assetsDir + "/vim.mp4"
 const badRequestHtml = `<html>
   <head>
     <title>400 Bad Request</title>
@@ -43,59 +53,81 @@ const okHtml = `<html>
 </html>`
 
 func main() {
-	server, err := server.Serve(port, handler)
+	middleware := server.Chain(server.RequestID(), server.Logging(log.Default()))
+	server, err := server.Serve(port, middleware(newRouter().ServeRequest),
+		server.WithHeaderReadTimeout(headerReadTimeout),
+		server.WithBodyReadTimeout(bodyReadTimeout),
+		server.WithIdleTimeout(idleTimeout),
+	)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+	log.Println("Shutting down, waiting for in-flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("ERROR: shutdown did not complete cleanly", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
 
-func handler(w *response.Writer, req *request.Request) *server.HandlerError {
-	if req.RequestLine.RequestTarget == "/yourproblem" {
+func newRouter() *router.Router {
+	rt := router.New()
+	rt.Get("/yourproblem", func(w *response.Writer, req *request.Request) *server.HandlerError {
 		return &server.HandlerError{Code: response.STATUS_CODE_BAD_REQUEST, Message: badRequestHtml}
-	}
-	if req.RequestLine.RequestTarget == "/myproblem" {
+	})
+	rt.Get("/myproblem", func(w *response.Writer, req *request.Request) *server.HandlerError {
 		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: internalServerErrorHtml}
+	})
+	rt.Get("/httpbin/stream/100", handleStreaming)
+	rt.Get("/video", handleVideo)
+	assets := fileserver.New(assetsDir, fileserver.WithPrefix("/assets"))
+	rt.Get("/assets/{path...}", assets.ServeRequest)
+	rt.Get("/{path...}", handleHome)
+	return rt
+}
+
+// okHtmlETag lets clients revalidate the home page instead of fetching it
+// again.
+var okHtmlETag = response.StrongETag([]byte(okHtml))
+
+func handleHome(w *response.Writer, req *request.Request) *server.HandlerError {
+	done, err := w.CheckPreconditions(req.RequestLine.Method, req.Headers, okHtmlETag, time.Time{})
+	if err != nil {
+		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
 	}
-	if req.RequestLine.RequestTarget == "/httpbin/stream/100" {
-		return handleStreaming(w)
-	}
-	if req.RequestLine.RequestTarget == "/video" {
-		return handleVideo(w)
+	if done {
+		return nil
 	}
-	headers := headers.GetDefaultHeaders(len(okHtml))
-	err := w.WriteStatusLine(response.STATUS_CODE_OK)
-	err = w.WriteHeaders(headers)
-	err = w.WriteBody([]byte(okHtml))
+	_, err = w.Write([]byte(okHtml))
 	if err != nil {
 		log.Println("ERROR: Writing handler", err)
 	}
 	return nil
 }
 
-func handleStreaming(w *response.Writer) *server.HandlerError {
-	res, err := http.Get("https://httpbin.org/stream/100")
+func handleStreaming(w *response.Writer, req *request.Request) *server.HandlerError {
+	// The upstream request is given up when the client goes away.
+	upstream, err := http.NewRequestWithContext(req.Context(), "GET", "https://httpbin.org/stream/100", nil)
 	if err != nil {
 		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
 	}
-	bufSize := 32
-	arr := make([]byte, bufSize)
-	responseHeaders := headers.GetDefaultHeaders(0)
-	responseHeaders.Replace("Transfer-Encoding", "chunked")
-	responseHeaders.Remove("content-length")
-	responseHeaders.Remove("connection")
-	responseHeaders.Set("Trailer", "example-trailer")
-	err = w.WriteStatusLine(response.STATUS_CODE_OK)
+	res, err := http.DefaultClient.Do(upstream)
 	if err != nil {
 		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
 	}
-	err = w.WriteHeaders(responseHeaders)
+	defer res.Body.Close()
+	bufSize := 32
+	arr := make([]byte, bufSize)
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Trailer", "example-trailer")
+	err = w.WriteHeader(response.STATUS_CODE_OK)
 	if err != nil {
 		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
 	}
@@ -131,24 +163,6 @@ func handleStreaming(w *response.Writer) *server.HandlerError {
 	return nil
 }
 
-func handleVideo(w *response.Writer) *server.HandlerError {
-	videoBytes, err := os.ReadFile("assets/vim.mp4")
-	if err != nil {
-		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
-	}
-	err = w.WriteStatusLine(response.STATUS_CODE_OK)
-	if err != nil {
-		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
-	}
-	headers := headers.GetDefaultHeaders(len(videoBytes))
-	headers.Set("content-type", "video/mp4")
-	err = w.WriteHeaders(headers)
-	if err != nil {
-		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
-	}
-	_, err = w.Write(videoBytes)
-	if err != nil {
-		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
-	}
-	return nil
+func handleVideo(w *response.Writer, req *request.Request) *server.HandlerError {
+	return fileserver.ServeFile(w, req, videoFile)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"httpFromTCP/internal/request"
+	"io"
 	"log"
 	"net"
 )
@@ -30,11 +31,15 @@ func main() {
 		fmt.Printf("- Target: %v\n", req.RequestLine.RequestTarget)
 		fmt.Printf("- Version: %v\n", req.RequestLine.HttpVersion)
 		fmt.Println("Headers: ")
-		for k := range req.Headers {
-			fmt.Printf("- %v: %v\n", k, req.Headers[k])
+		for name, value := range req.Headers.All() {
+			fmt.Printf("- %v: %v\n", name, value)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			log.Println("Warning reading body failed: ", err)
 		}
 		fmt.Println("Body:")
-		fmt.Printf("%v", string(req.Body))
+		fmt.Printf("%v", string(body))
 		fmt.Println("Closing since channel has closed!")
 	}
 }
@@ -0,0 +1,346 @@
+// Package fileserver serves the files below a directory.
+//
+// Request paths are resolved segment by segment below the root: segments
+// that would climb out of it are refused, and so are symbolic links pointing
+// outside of it. Names starting with a dot are treated as missing so that
+// files such as .env or .git are never served. A directory is answered with
+// its index.html, or with a listing of its entries when listings are
+// enabled.
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"httpFromTCP/internal/headers"
+	"httpFromTCP/internal/request"
+	"httpFromTCP/internal/response"
+	"httpFromTCP/internal/server"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const INDEX_FILE = "index.html"
+
+const notFoundMessage = "no such file"
+const forbiddenMessage = "access to the file is not allowed"
+const invalidPathMessage = "the request path is not a valid file path"
+const methodNotAllowedMessage = "files can only be read with GET or HEAD"
+
+// FileServer is a server.Handler serving the files below a directory.
+type FileServer struct {
+	root            string
+	prefix          []string
+	listDirectories bool
+}
+
+type Option func(*FileServer)
+
+// WithPrefix strips prefix from request paths before they are looked up, for
+// a file server mounted below the root of the site. Paths outside of prefix
+// are not found.
+func WithPrefix(prefix string) Option {
+	return func(s *FileServer) {
+		s.prefix = strings.Split(strings.Trim(prefix, "/"), "/")
+		if s.prefix[0] == "" {
+			s.prefix = nil
+		}
+	}
+}
+
+// WithDirectoryListing makes directories without an index.html answer with
+// a page listing their entries, instead of a 403.
+func WithDirectoryListing() Option {
+	return func(s *FileServer) {
+		s.listDirectories = true
+	}
+}
+
+func New(root string, options ...Option) *FileServer {
+	s := &FileServer{root: root}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// ServeRequest answers GET and HEAD requests with the file the request path
+// names. A directory requested without a trailing slash is redirected to the
+// path with one, so that relative links in its index resolve below it.
+func (s *FileServer) ServeRequest(w *response.Writer, req *request.Request) *server.HandlerError {
+	if method := req.RequestLine.Method; method != "GET" && method != "HEAD" {
+		return methodNotAllowed(w)
+	}
+	segments := req.URL.Segments()
+	if len(segments) < len(s.prefix) || !slices.Equal(segments[:len(s.prefix)], s.prefix) {
+		return &server.HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: notFoundMessage}
+	}
+	segments = segments[len(s.prefix):]
+	if len(segments) == 0 {
+		// The prefix itself, which is a directory.
+		segments = []string{""}
+	}
+	name, handlerErr := s.resolve(segments)
+	if handlerErr != nil {
+		return handlerErr
+	}
+	file, info, handlerErr := open(name)
+	if handlerErr != nil {
+		return handlerErr
+	}
+	defer file.Close()
+	wantsDirectory := segments[len(segments)-1] == ""
+	if !info.IsDir() {
+		if wantsDirectory {
+			return &server.HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: notFoundMessage}
+		}
+		return serveContent(w, req, file, info)
+	}
+	if !wantsDirectory {
+		return redirect(w, req.URL.RawPath+"/", req.URL.RawQuery)
+	}
+	index, handlerErr := s.serveIndex(w, req, filepath.Join(name, INDEX_FILE))
+	if index {
+		return handlerErr
+	}
+	if !s.listDirectories {
+		return &server.HandlerError{Code: response.STATUS_CODE_FORBIDDEN, Message: forbiddenMessage}
+	}
+	return listDirectory(w, file, req.URL.Path, len(segments) > 1 || len(s.prefix) > 0)
+}
+
+// ServeFile answers GET and HEAD requests with the file at name, which is
+// used as is and may be anywhere.
+func ServeFile(w *response.Writer, req *request.Request, name string) *server.HandlerError {
+	if method := req.RequestLine.Method; method != "GET" && method != "HEAD" {
+		return methodNotAllowed(w)
+	}
+	file, info, handlerErr := open(name)
+	if handlerErr != nil {
+		return handlerErr
+	}
+	defer file.Close()
+	if info.IsDir() {
+		return &server.HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: notFoundMessage}
+	}
+	return serveContent(w, req, file, info)
+}
+
+// resolve turns the decoded path segments into a file name below the root.
+func (s *FileServer) resolve(segments []string) (string, *server.HandlerError) {
+	for i, segment := range segments {
+		if segment == "" && i != len(segments)-1 {
+			// An empty segment in the middle, from a double slash.
+			return "", &server.HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: notFoundMessage}
+		}
+		if segment == "." || segment == ".." || strings.ContainsAny(segment, "/\\\x00") {
+			return "", &server.HandlerError{Code: response.STATUS_CODE_BAD_REQUEST, Message: invalidPathMessage}
+		}
+		if strings.HasPrefix(segment, ".") {
+			return "", &server.HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: notFoundMessage}
+		}
+	}
+	name := filepath.Join(append([]string{s.root}, segments...)...)
+	if handlerErr := s.checkContained(name); handlerErr != nil {
+		return "", handlerErr
+	}
+	return name, nil
+}
+
+// checkContained refuses a name below the root that is, or goes through, a
+// symbolic link pointing outside of the root.
+func (s *FileServer) checkContained(name string) *server.HandlerError {
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return fileError(err)
+	}
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return fileError(err)
+	}
+	if relative, err := filepath.Rel(root, target); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return &server.HandlerError{Code: response.STATUS_CODE_FORBIDDEN, Message: forbiddenMessage}
+	}
+	return nil
+}
+
+// serveIndex answers with the index file of a directory. It reports false
+// when the directory has none, so that it is listed or refused instead. An
+// index that is a link pointing outside of the root is refused.
+func (s *FileServer) serveIndex(w *response.Writer, req *request.Request, name string) (bool, *server.HandlerError) {
+	handlerErr := s.checkContained(name)
+	if handlerErr != nil {
+		return handlerErr.Code != response.STATUS_CODE_NOT_FOUND, handlerErr
+	}
+	index, info, handlerErr := open(name)
+	if handlerErr != nil {
+		return handlerErr.Code != response.STATUS_CODE_NOT_FOUND, handlerErr
+	}
+	defer index.Close()
+	if info.IsDir() {
+		return false, nil
+	}
+	return true, serveContent(w, req, index, info)
+}
+
+func open(name string) (*os.File, fs.FileInfo, *server.HandlerError) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, fileError(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fileError(err)
+	}
+	return file, info, nil
+}
+
+// fileError maps an error opening a file to the status it is answered with.
+func fileError(err error) *server.HandlerError {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return &server.HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: notFoundMessage}
+	case errors.Is(err, fs.ErrPermission):
+		return &server.HandlerError{Code: response.STATUS_CODE_FORBIDDEN, Message: forbiddenMessage}
+	}
+	return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+}
+
+func methodNotAllowed(w *response.Writer) *server.HandlerError {
+	w.Header().Set("Allow", "GET, HEAD")
+	w.Header().Set(headers.CONTENT_TYPE, "text/plain")
+	return writeResponse(w, response.STATUS_CODE_METHOD_NOT_ALLOWED, []byte(methodNotAllowedMessage))
+}
+
+// serveContent streams a regular file, which is never read into memory as a
+// whole. The response carries a weak ETag and the modification time of the
+// file, against which conditional requests are evaluated first.
+func serveContent(w *response.Writer, req *request.Request, file *os.File, info fs.FileInfo) *server.HandlerError {
+	if !info.Mode().IsRegular() {
+		// Devices and pipes have no content that could be served.
+		return &server.HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: notFoundMessage}
+	}
+	etag := response.WeakETag(info.ModTime(), info.Size())
+	done, err := w.CheckPreconditions(req.RequestLine.Method, req.Headers, etag, info.ModTime())
+	if err != nil {
+		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	if done {
+		return nil
+	}
+	mimeType, err := contentType(info.Name(), file)
+	if err != nil {
+		return fileError(err)
+	}
+	w.Header().Set(headers.ACCEPT_RANGES, "bytes")
+	if served, handlerErr := serveRanges(w, req, file, info, etag, mimeType); served {
+		return handlerErr
+	}
+	w.Header().Set(headers.CONTENT_TYPE, mimeType)
+	w.Header().Set(headers.CONTENT_LENGTH, strconv.FormatInt(info.Size(), 10))
+	if err := w.WriteHeader(response.STATUS_CODE_OK); err != nil {
+		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	if req.RequestLine.Method == "HEAD" {
+		return nil
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	return nil
+}
+
+// serveRanges answers with the parts of the file a GET request asked for in
+// its Range header. It reports false when the whole file is to be sent
+// instead: without a Range, when If-Range no longer matches, or when the
+// Range is malformed or asks for too much.
+func serveRanges(w *response.Writer, req *request.Request, file *os.File, info fs.FileInfo, etag string, mimeType string) (bool, *server.HandlerError) {
+	value, ok := req.Headers.Get(headers.RANGE)
+	if !ok || req.RequestLine.Method != "GET" {
+		return false, nil
+	}
+	if ifRange, ok := req.Headers.Get(headers.IF_RANGE); ok && !response.IfRangeMatches(ifRange, etag, info.ModTime()) {
+		return false, nil
+	}
+	ranges, err := response.ParseRange(value, info.Size())
+	switch {
+	case errors.Is(err, response.ErrRangeNotSatisfiable):
+		err = w.WriteRangeNotSatisfiable(info.Size())
+	case err != nil:
+		return false, nil
+	default:
+		err = w.WriteRanges(file, info.Size(), mimeType, ranges)
+	}
+	if err != nil {
+		return true, &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	return true, nil
+}
+
+func redirect(w *response.Writer, location string, rawQuery string) *server.HandlerError {
+	if rawQuery != "" {
+		location += "?" + rawQuery
+	}
+	w.Header().Set("Location", location)
+	return writeResponse(w, response.STATUS_CODE_MOVED_PERMANENTLY, nil)
+}
+
+// listDirectory answers with a page linking to the entries of the directory,
+// directories first and each group sorted by name.
+func listDirectory(w *response.Writer, dir *os.File, path string, hasParent bool) *server.HandlerError {
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return fileError(err)
+	}
+	entries = slices.DeleteFunc(entries, func(entry fs.DirEntry) bool {
+		return strings.HasPrefix(entry.Name(), ".")
+	})
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		if a.IsDir() != b.IsDir() {
+			if a.IsDir() {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	var page strings.Builder
+	title := html.EscapeString("Index of " + path)
+	fmt.Fprintf(&page, "<!DOCTYPE html>\n<html>\n<head><title>%v</title></head>\n<body>\n<h1>%v</h1>\n<ul>\n", title, title)
+	if hasParent {
+		page.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).EscapedPath()
+		if strings.Contains(name, ":") {
+			// A colon in the first segment would read as a scheme.
+			href = "./" + href
+		}
+		fmt.Fprintf(&page, "<li><a href=\"%v\">%v</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	page.WriteString("</ul>\n</body>\n</html>\n")
+	w.Header().Set(headers.CONTENT_TYPE, "text/html; charset=utf-8")
+	return writeResponse(w, response.STATUS_CODE_OK, []byte(page.String()))
+}
+
+func writeResponse(w *response.Writer, statusCode response.StatusCode, body []byte) *server.HandlerError {
+	if err := w.WriteHeader(statusCode); err != nil {
+		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	if _, err := w.Write(body); err != nil {
+		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"httpFromTCP/internal/request"
+	"httpFromTCP/internal/response"
+	"httpFromTCP/internal/server"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request with the given header fields through handler. It
+// returns the handler error, or the response that was written when there is
+// none.
+func serve(t *testing.T, handler server.Handler, method, target string, fields ...string) (*http.Response, string, *server.HandlerError) {
+	t.Helper()
+	head := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+	for _, field := range fields {
+		head += field + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(head + "\r\n"))
+	require.NoError(t, err)
+	buffer := &bytes.Buffer{}
+	w := response.NewWriter(buffer)
+	w.SetOmitBody(method == "HEAD")
+	handlerErr := handler(w, req)
+	if handlerErr != nil {
+		return nil, "", handlerErr
+	}
+	require.NoError(t, w.Finish())
+	res, err := http.ReadResponse(bufio.NewReader(buffer), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body), nil
+}
+
+// writeFiles creates the files below dir, with directories as needed.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+}
+
+func TestServeFiles(t *testing.T) {
+	root := t.TempDir()
+	large := strings.Repeat("0123456789", 10*response.BODY_BUFFER_SIZE)
+	writeFiles(t, root, map[string]string{
+		"index.html":     "<h1>home</h1>",
+		"css/site.css":   "body {}",
+		"image":          "\x89PNG\x0D\x0A\x1A\x0A rest of the image",
+		"notes.TXT":      "plain",
+		"large.bin":      large,
+		"with space.txt": "spaced",
+	})
+	handler := New(root).ServeRequest
+
+	cases := []struct {
+		target      string
+		contentType string
+		body        string
+	}{
+		{"/", "text/html; charset=utf-8", "<h1>home</h1>"},
+		{"/index.html", "text/html; charset=utf-8", "<h1>home</h1>"},
+		{"/css/site.css", "text/css; charset=utf-8", "body {}"},
+		{"/image", "image/png", "\x89PNG\x0D\x0A\x1A\x0A rest of the image"},
+		{"/notes.TXT", "text/plain; charset=utf-8", "plain"},
+		{"/with%20space.txt?v=2", "text/plain; charset=utf-8", "spaced"},
+		{"/large.bin", "text/plain; charset=utf-8", large},
+	}
+	for _, c := range cases {
+		res, body, handlerErr := serve(t, handler, "GET", c.target)
+		require.Nil(t, handlerErr, c.target)
+		assert.Equal(t, 200, res.StatusCode, c.target)
+		assert.Equal(t, c.contentType, res.Header.Get("Content-Type"), c.target)
+		// Test: the length is declared up front rather than chunked
+		assert.Equal(t, int64(len(c.body)), res.ContentLength, c.target)
+		assert.Equal(t, c.body, body, c.target)
+	}
+
+	// Test: HEAD gets the headers only
+	res, body, handlerErr := serve(t, handler, "HEAD", "/large.bin")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, int64(len(large)), res.ContentLength)
+	assert.Empty(t, body)
+
+	// Test: other methods are not allowed
+	res, _, handlerErr = serve(t, handler, "POST", "/index.html")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 405, res.StatusCode)
+	assert.Equal(t, "GET, HEAD", res.Header.Get("Allow"))
+
+	_, _, handlerErr = serve(t, handler, "GET", "/missing.txt")
+	require.NotNil(t, handlerErr)
+	assert.Equal(t, response.STATUS_CODE_NOT_FOUND, handlerErr.Code)
+}
+
+func TestRefusesPathsOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"secret.txt":        "secret",
+		"public/file.txt":   "public",
+		"public/.env":       "TOKEN=1",
+		"public/.git/HEAD":  "ref",
+		"public/sub/a.txt":  "a",
+		"outside/other.txt": "other",
+	})
+	root := filepath.Join(dir, "public")
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "link.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "outside"), filepath.Join(root, "linked")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "file.txt"), filepath.Join(root, "inside.txt")))
+	handler := New(root).ServeRequest
+
+	cases := []struct {
+		target string
+		code   response.StatusCode
+	}{
+		{"/../secret.txt", response.STATUS_CODE_BAD_REQUEST},
+		{"/sub/../../secret.txt", response.STATUS_CODE_BAD_REQUEST},
+		{"/%2e%2e/secret.txt", response.STATUS_CODE_BAD_REQUEST},
+		{"/sub%2F..%2F..%2Fsecret.txt", response.STATUS_CODE_BAD_REQUEST},
+		{"/..%5Csecret.txt", response.STATUS_CODE_BAD_REQUEST},
+		{"/file.txt%00.png", response.STATUS_CODE_BAD_REQUEST},
+		{"/./file.txt", response.STATUS_CODE_BAD_REQUEST},
+		{"/.env", response.STATUS_CODE_NOT_FOUND},
+		{"/.git/HEAD", response.STATUS_CODE_NOT_FOUND},
+		{"/sub//a.txt", response.STATUS_CODE_NOT_FOUND},
+		{"/link.txt", response.STATUS_CODE_FORBIDDEN},
+		{"/linked/other.txt", response.STATUS_CODE_FORBIDDEN},
+	}
+	for _, c := range cases {
+		_, _, handlerErr := serve(t, handler, "GET", c.target)
+		require.NotNil(t, handlerErr, c.target)
+		assert.Equal(t, c.code, handlerErr.Code, c.target)
+	}
+
+	// Test: links that stay below the root are followed
+	_, body, handlerErr := serve(t, handler, "GET", "/inside.txt")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "public", body)
+
+	// Test: an index that links outside of the root is refused too, with or
+	// without listings
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "sub", INDEX_FILE)))
+	for _, s := range []*FileServer{New(root), New(root, WithDirectoryListing())} {
+		_, _, handlerErr = serve(t, s.ServeRequest, "GET", "/sub/")
+		require.NotNil(t, handlerErr)
+		assert.Equal(t, response.STATUS_CODE_FORBIDDEN, handlerErr.Code)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"docs/index.html":      "docs index",
+		"files/b.txt":          "b",
+		"files/a <&>.txt":      "a",
+		"files/.hidden":        "hidden",
+		"files/nested/c.txt":   "c",
+		"files/colon:name.txt": "colon",
+	})
+
+	// Test: a directory without trailing slash is redirected
+	res, _, handlerErr := serve(t, New(root).ServeRequest, "GET", "/docs?page=2")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 301, res.StatusCode)
+	assert.Equal(t, "/docs/?page=2", res.Header.Get("Location"))
+
+	_, body, handlerErr := serve(t, New(root).ServeRequest, "GET", "/docs/")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "docs index", body)
+
+	// Test: a file is not a directory
+	_, _, handlerErr = serve(t, New(root).ServeRequest, "GET", "/files/b.txt/")
+	require.NotNil(t, handlerErr)
+	assert.Equal(t, response.STATUS_CODE_NOT_FOUND, handlerErr.Code)
+
+	// Test: listings are off by default
+	_, _, handlerErr = serve(t, New(root).ServeRequest, "GET", "/files/")
+	require.NotNil(t, handlerErr)
+	assert.Equal(t, response.STATUS_CODE_FORBIDDEN, handlerErr.Code)
+
+	res, body, handlerErr = serve(t, New(root, WithDirectoryListing()).ServeRequest, "GET", "/files/")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, body, "<title>Index of /files/</title>")
+	assert.Contains(t, body, `<a href="../">../</a>`)
+	assert.Contains(t, body, `<a href="nested/">nested/</a>`)
+	assert.Contains(t, body, `<a href="a%20%3C&amp;%3E.txt">a &lt;&amp;&gt;.txt</a>`)
+	assert.Contains(t, body, `<a href="./colon:name.txt">colon:name.txt</a>`)
+	assert.NotContains(t, body, ".hidden")
+	// Test: directories come first, then files by name
+	assert.Less(t, strings.Index(body, "nested/"), strings.Index(body, "a &lt;"))
+	assert.Less(t, strings.Index(body, "a &lt;"), strings.Index(body, "b.txt"))
+}
+
+func TestPrefixAndServeFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"app.js": "run()", "clip.mp4": "\x00\x00\x00\x18ftypmp42"})
+	handler := New(root, WithPrefix("/static/")).ServeRequest
+
+	res, body, handlerErr := serve(t, handler, "GET", "/static/app.js")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "text/javascript; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "run()", body)
+	_, _, handlerErr = serve(t, handler, "GET", "/app.js")
+	require.NotNil(t, handlerErr)
+	assert.Equal(t, response.STATUS_CODE_NOT_FOUND, handlerErr.Code)
+
+	serveClip := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		return ServeFile(w, req, filepath.Join(root, "clip.mp4"))
+	}
+	res, body, handlerErr = serve(t, serveClip, "GET", "/video")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "video/mp4", res.Header.Get("Content-Type"))
+	assert.Equal(t, "\x00\x00\x00\x18ftypmp42", body)
+}
+
+func TestRanges(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"clip.mp4": "0123456789abcdefghij"})
+	modTime := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "clip.mp4"), modTime, modTime))
+	handler := New(root).ServeRequest
+
+	res, body, handlerErr := serve(t, handler, "GET", "/clip.mp4")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+	assert.Equal(t, 200, res.StatusCode)
+
+	res, body, handlerErr = serve(t, handler, "GET", "/clip.mp4", "Range: bytes=-5")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Equal(t, "video/mp4", res.Header.Get("Content-Type"))
+	assert.Equal(t, "bytes 15-19/20", res.Header.Get("Content-Range"))
+	assert.Equal(t, "fghij", body)
+
+	// Test: several ranges come back as multipart/byteranges
+	res, body, handlerErr = serve(t, handler, "GET", "/clip.mp4", "Range: bytes=0-1,10-")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 206, res.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for _, expected := range []string{"01", "abcdefghij"} {
+		part, err := reader.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, "video/mp4", part.Header.Get("Content-Type"))
+		data, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	res, _, handlerErr = serve(t, handler, "GET", "/clip.mp4", "Range: bytes=20-")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 416, res.StatusCode)
+	assert.Equal(t, "bytes */20", res.Header.Get("Content-Range"))
+
+	// Test: the whole file is sent for a malformed Range, to HEAD requests,
+	// and when If-Range does not match
+	ignored := []struct {
+		method string
+		fields []string
+	}{
+		{"GET", []string{"Range: bytes=5-1"}},
+		{"GET", []string{"Range: lines=1-2"}},
+		{"HEAD", []string{"Range: bytes=0-1"}},
+		{"GET", []string{"Range: bytes=0-1", "If-Range: Fri, 01 Mar 2024 11:59:59 GMT"}},
+		{"GET", []string{"Range: bytes=0-1", "If-Range: \"some-etag\""}},
+	}
+	for _, c := range ignored {
+		res, _, handlerErr := serve(t, handler, c.method, "/clip.mp4", c.fields...)
+		require.Nil(t, handlerErr, c.fields)
+		assert.Equal(t, 200, res.StatusCode, c.fields)
+		assert.Equal(t, int64(20), res.ContentLength, c.fields)
+	}
+
+	res, body, handlerErr = serve(t, handler, "GET", "/clip.mp4", "Range: bytes=0-1", "If-Range: Fri, 01 Mar 2024 12:00:00 GMT")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Equal(t, "01", body)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"page.html": "<p>page</p>"})
+	modTime := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "page.html"), modTime, modTime))
+	handler := New(root).ServeRequest
+
+	res, _, handlerErr := serve(t, handler, "GET", "/page.html")
+	require.Nil(t, handlerErr)
+	etag := res.Header.Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`), etag)
+	assert.Equal(t, "Fri, 01 Mar 2024 12:00:00 GMT", res.Header.Get("Last-Modified"))
+
+	cases := []struct {
+		method   string
+		fields   []string
+		expected int
+	}{
+		{"GET", []string{"If-None-Match: " + etag}, 304},
+		{"HEAD", []string{"If-None-Match: " + etag}, 304},
+		{"GET", []string{"If-None-Match: \"other\""}, 200},
+		{"GET", []string{"If-Modified-Since: Fri, 01 Mar 2024 12:00:00 GMT"}, 304},
+		{"GET", []string{"If-Modified-Since: Fri, 01 Mar 2024 11:00:00 GMT"}, 200},
+		{"GET", []string{"If-None-Match: \"other\"", "If-Modified-Since: Fri, 01 Mar 2024 12:00:00 GMT"}, 200},
+		// A weak tag never satisfies If-Match
+		{"GET", []string{"If-Match: " + etag}, 412},
+		{"GET", []string{"If-Unmodified-Since: Fri, 01 Mar 2024 11:00:00 GMT"}, 412},
+		{"GET", []string{"If-Unmodified-Since: Fri, 01 Mar 2024 12:00:00 GMT"}, 200},
+		// Preconditions are evaluated before ranges, and a weak tag never
+		// satisfies If-Range either
+		{"GET", []string{"If-None-Match: " + etag, "Range: bytes=0-1"}, 304},
+		{"GET", []string{"If-Range: " + etag, "Range: bytes=0-1"}, 200},
+	}
+	for _, c := range cases {
+		res, body, handlerErr := serve(t, handler, c.method, "/page.html", c.fields...)
+		require.Nil(t, handlerErr, c.fields)
+		assert.Equal(t, c.expected, res.StatusCode, "%v %v", c.method, c.fields)
+		if c.expected == 304 {
+			assert.Empty(t, body)
+			assert.Equal(t, etag, res.Header.Get("ETag"))
+		}
+	}
+}
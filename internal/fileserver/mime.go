@@ -0,0 +1,68 @@
+package fileserver
+
+import (
+	"httpFromTCP/internal/response"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// mimeTypes maps file extensions to media types. It is kept here rather than
+// taken from the system so that a file is served the same way everywhere.
+var mimeTypes = map[string]string{
+	".avif":  "image/avif",
+	".bmp":   "image/bmp",
+	".css":   "text/css; charset=utf-8",
+	".csv":   "text/csv; charset=utf-8",
+	".gif":   "image/gif",
+	".gz":    "application/gzip",
+	".htm":   "text/html; charset=utf-8",
+	".html":  "text/html; charset=utf-8",
+	".ico":   "image/vnd.microsoft.icon",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".js":    "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".m4a":   "audio/mp4",
+	".md":    "text/markdown; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".mov":   "video/quicktime",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".oga":   "audio/ogg",
+	".ogg":   "audio/ogg",
+	".ogv":   "video/ogg",
+	".otf":   "font/otf",
+	".pdf":   "application/pdf",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".tar":   "application/x-tar",
+	".ttf":   "font/ttf",
+	".txt":   "text/plain; charset=utf-8",
+	".wasm":  "application/wasm",
+	".wav":   "audio/wav",
+	".webm":  "video/webm",
+	".webp":  "image/webp",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".xml":   "text/xml; charset=utf-8",
+	".zip":   "application/zip",
+}
+
+// contentType returns the media type of a file from its extension, sniffing
+// the start of its content when the extension is unknown. The content is
+// read through file and then rewound.
+func contentType(name string, file io.ReadSeeker) (string, error) {
+	if mimeType, ok := mimeTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return mimeType, nil
+	}
+	sample := make([]byte, response.SNIFF_LENGTH)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return response.DetectContentType(sample[:n]), nil
+}
@@ -2,123 +2,256 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"httpFromTCP/internal/constants"
-	"httpFromTCP/internal/utils"
-	"maps"
+	"iter"
+	"slices"
 	"strconv"
 
 	"regexp"
 	"strings"
 )
 
-type Headers map[string]string
+// Headers holds header or trailer fields as they appeared on the wire: every
+// field line is kept in order with its original name casing. Names are
+// matched case-insensitively. The zero value is an empty set of fields, and a
+// nil *Headers reads as empty too.
+type Headers struct {
+	fields []Field
+}
+
+type Field struct {
+	Name  string
+	Value string
+}
 
 const CONTENT_LENGTH = "content-length"
+const CONNECTION = "connection"
+const TRANSFER_ENCODING = "transfer-encoding"
+const CONTENT_TYPE = "content-type"
+const RANGE = "range"
+const IF_RANGE = "if-range"
+const ACCEPT_RANGES = "accept-ranges"
+const CONTENT_RANGE = "content-range"
+const ETAG = "etag"
+const LAST_MODIFIED = "last-modified"
+const IF_MATCH = "if-match"
+const IF_NONE_MATCH = "if-none-match"
+const IF_MODIFIED_SINCE = "if-modified-since"
+const IF_UNMODIFIED_SINCE = "if-unmodified-since"
+
+// SET_COOKIE may only be sent as separate field lines, its values can contain
+// commas and are never joined.
+const SET_COOKIE = "set-cookie"
+
+var (
+	ErrMalformedHeader    = errors.New("header: malformed header line")
+	ErrInvalidHeaderName  = errors.New("header: invalid header name")
+	ErrBareLineBreak      = errors.New("header: bare CR or LF in header line")
+	ErrInvalidHeaderValue = errors.New("header: invalid header value")
+)
 
 var validHeaderNamesRegex = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+\\-.^_`|~]+$")
 
-func NewHeaders() Headers {
-	return make(map[string]string)
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
-func (h Headers) Parse(data []byte) (int, bool, error) {
+func (h *Headers) Parse(data []byte) (int, bool, error) {
 	separatorIndex := bytes.Index(data, []byte(constants.SEPARATOR))
 	if separatorIndex == 0 {
 		return len(constants.SEPARATOR), true, nil
 	}
 	if separatorIndex == -1 {
+		// Without a CRLF in sight any LF is a bare one.
+		if bytes.IndexByte(data, '\n') != -1 {
+			return 0, false, ErrBareLineBreak
+		}
 		return 0, false, nil
 	}
+	if bytes.ContainsAny(data[:separatorIndex], "\r\n") {
+		return 0, false, ErrBareLineBreak
+	}
 	header := string(data[:separatorIndex])
 
-	headers, err := validateHeader(header)
+	field, err := validateHeader(header)
 
 	if err != nil {
 		return 0, false, err
 	}
-	h.mergeHeaders(headers.normalizeHeaderKeys())
+	h.fields = append(h.fields, field)
 	return separatorIndex + len(constants.SEPARATOR), false, nil
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	val, ok := h[strings.ToLower(key)]
-	return val, ok
+// Get returns the values of the named field joined with ", ", which is how a
+// repeated field combines into one. Set-Cookie can't be combined that way, so
+// only its first value is returned; use Values for all of them.
+func (h *Headers) Get(name string) (string, bool) {
+	values := h.Values(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	if strings.EqualFold(name, SET_COOKIE) {
+		return values[0], true
+	}
+	return strings.Join(values, ", "), true
+}
+
+// Values returns the value of every field line with the given name, in order.
+func (h *Headers) Values(name string) []string {
+	if h == nil {
+		return nil
+	}
+	var values []string
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, name) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Add appends a field line, keeping any existing ones with the same name.
+func (h *Headers) Add(name string, value string) {
+	h.fields = append(h.fields, Field{Name: name, Value: value})
 }
 
-func (h Headers) Set(headerName string, headerValue string) {
-	h[strings.ToLower(headerName)] = headerValue
+// Set replaces every field line with the given name by a single one, which
+// takes the place of the first of them.
+func (h *Headers) Set(name string, value string) {
+	fields := h.fields[:0]
+	set := false
+	for _, field := range h.fields {
+		if !strings.EqualFold(field.Name, name) {
+			fields = append(fields, field)
+		} else if !set {
+			fields = append(fields, Field{Name: name, Value: value})
+			set = true
+		}
+	}
+	if !set {
+		fields = append(fields, Field{Name: name, Value: value})
+	}
+	h.fields = fields
+}
+
+// Del removes every field line with the given name.
+func (h *Headers) Del(name string) {
+	h.fields = slices.DeleteFunc(h.fields, func(field Field) bool {
+		return strings.EqualFold(field.Name, name)
+	})
 }
 
-func GetDefaultHeaders(contentSize int) Headers {
+// Len returns the number of field lines.
+func (h *Headers) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.fields)
+}
+
+// All iterates over the field lines in order.
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if h == nil {
+			return
+		}
+		for _, field := range h.fields {
+			if !yield(field.Name, field.Value) {
+				return
+			}
+		}
+	}
+}
+
+func GetDefaultHeaders(contentSize int) *Headers {
 	headers := NewHeaders()
-	headers.Set("content-length", strconv.Itoa(contentSize))
-	headers.Set("connection", "close")
-	headers.Set("content-type", "text/plain")
+	headers.Set(CONTENT_LENGTH, strconv.Itoa(contentSize))
+	headers.Set(CONTENT_TYPE, "text/plain")
 	return headers
 }
 
-func (h Headers) Replace(key, value string) {
-	h[strings.ToLower(key)] = value
+func (h *Headers) Replace(key, value string) {
+	h.Set(key, value)
 }
 
-func (h Headers) Remove(key string) {
-	delete(h, key)
+func (h *Headers) Remove(key string) {
+	h.Del(key)
 }
 
-func (h Headers) GetAsStringWithoutFinalTermination() string {
-	headersString := ""
-	for k, v := range h {
-		headersString += fmt.Sprintf("%v: %v%v", k, v, constants.SEPARATOR)
+// HasToken reports whether a comma separated header value such as the one of
+// Connection contains token, ignoring case.
+func HasToken(value string, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
 	}
-	return headersString
+	return false
 }
 
-func (h Headers) GetAsString() string {
-	headersString := ""
-	for k, v := range h {
-		headersString += fmt.Sprintf("%v: %v%v", k, v, constants.SEPARATOR)
+func (h *Headers) GetAsStringWithoutFinalTermination() string {
+	var headersString strings.Builder
+	for name, value := range h.All() {
+		headersString.WriteString(name + ": " + value + constants.SEPARATOR)
 	}
-	headersString += constants.SEPARATOR
-	return headersString
+	return headersString.String()
+}
+
+func (h *Headers) GetAsString() string {
+	return h.GetAsStringWithoutFinalTermination() + constants.SEPARATOR
 }
 
-func validateHeader(header string) (Headers, error) {
+func validateHeader(header string) (Field, error) {
 	headerParts := strings.SplitN(header, ":", 2)
-	headers := make(Headers)
 	if len(headerParts) != 2 {
-		return Headers{}, fmt.Errorf("header: header has too many parts")
+		return Field{}, fmt.Errorf("%w: header line has no colon", ErrMalformedHeader)
 	}
 	headerName := headerParts[0]
 	headerValue := headerParts[1]
-	hasInvalidSpaces := strings.HasSuffix(headerName, " ")
+	hasInvalidSpaces := strings.HasSuffix(headerName, " ") || strings.HasSuffix(headerName, "\t")
 	if hasInvalidSpaces {
-		return Headers{}, fmt.Errorf("header: header name or valud has spaces in invalid locations")
+		return Field{}, fmt.Errorf("%w: header name or value has spaces in invalid locations", ErrInvalidHeaderName)
 	}
 	trimmedHeaderName := strings.TrimSpace(headerName)
 	if !validHeaderNamesRegex.Match([]byte(trimmedHeaderName)) {
-		return Headers{}, fmt.Errorf("header: header name contains unsupported characters")
+		return Field{}, fmt.Errorf("%w: header name contains unsupported characters", ErrInvalidHeaderName)
 	}
 	if strings.Contains(trimmedHeaderName, " ") {
-		return Headers{}, fmt.Errorf("header: header name contains spaces")
+		return Field{}, fmt.Errorf("%w: header name contains spaces", ErrInvalidHeaderName)
 	}
-	headers[trimmedHeaderName] = strings.TrimSpace(headerValue)
-	return headers, nil
+	if i := strings.IndexFunc(headerValue, isForbiddenValueRune); i != -1 {
+		return Field{}, fmt.Errorf("%w: control character %q in value of %v", ErrInvalidHeaderValue, headerValue[i], trimmedHeaderName)
+	}
+	return Field{Name: trimmedHeaderName, Value: strings.TrimSpace(headerValue)}, nil
 }
 
-func (h Headers) normalizeHeaderKeys() Headers {
-	normalizedHeaders := make(Headers, len(h))
-	for k := range h {
-		normalizedHeaders[strings.ToLower(k)] = h[k]
+// ValidateField checks a field about to be sent: the name must be a token
+// and the value must not contain CR, LF or NUL, which would let the value
+// end the field line early and forge further fields or a body.
+func ValidateField(name, value string) error {
+	if !validHeaderNamesRegex.MatchString(name) {
+		return fmt.Errorf("%w: %q is not a valid field name", ErrInvalidHeaderName, name)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("%w: value of %v contains CR, LF or NUL", ErrInvalidHeaderValue, name)
 	}
-	return normalizedHeaders
+	return nil
 }
 
-func (h1 Headers) mergeHeaders(h2 Headers) {
-	h3 := utils.MergeMaps(h1, h2, resolver)
-	maps.Copy(h1, h3)
+// Validate checks every field with ValidateField.
+func (h *Headers) Validate() error {
+	for name, value := range h.All() {
+		if err := ValidateField(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func resolver(a, b string) string {
-	return fmt.Sprintf("%s, %s", a, b)
+// isForbiddenValueRune reports whether r is a control character that may not
+// appear in a received field value. Horizontal tab is the only one allowed.
+func isForbiddenValueRune(r rune) bool {
+	return (r < ' ' && r != '\t') || r == 0x7F
 }
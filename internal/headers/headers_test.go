@@ -7,13 +7,19 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// value returns the combined value of a field, or "" when it's missing.
+func value(h *Headers, name string) string {
+	v, _ := h.Get(name)
+	return v
+}
+
 func TestValidHeaders(t *testing.T) {
 	headers := NewHeaders()
 	data := []byte("Host: localhost:42069\r\n\r\n")
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 }
@@ -24,7 +30,7 @@ func TestValidSingleHeaderWithSpace(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
 	assert.Equal(t, 32, n)
 	assert.False(t, done)
 }
@@ -35,14 +41,14 @@ func TestValidMultipleHeader(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
 	n2, done, err := headers.Parse(data[23:])
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "1234", headers["content-length"])
+	assert.Equal(t, "1234", value(headers, "content-length"))
 	assert.Equal(t, 23, n2)
 	assert.False(t, done)
 
@@ -59,7 +65,7 @@ func TestValidDone(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
 	assert.Equal(t, 32, n)
 	assert.False(t, done)
 	n, done, err = headers.Parse(data[32:])
@@ -73,7 +79,7 @@ func TestValidHeadersMerged(t *testing.T) {
 	n, done, err = headers.Parse(data[n:])
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "jack, rock", headers["liked-by"])
+	assert.Equal(t, "jack, rock", value(headers, "liked-by"))
 	assert.False(t, done)
 }
 
@@ -95,3 +101,99 @@ func TestInvalidHeaderNameWithUnsupportedCharacters(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestInvalidHeaderNameWithTabBeforeColon(t *testing.T) {
+	headers := NewHeaders()
+	data := []byte("Host\t: localhost:42069\r\n\r\n")
+	n, done, err := headers.Parse(data)
+	require.ErrorIs(t, err, ErrInvalidHeaderName)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestInvalidHeaderWithBareLineBreak(t *testing.T) {
+	headers := NewHeaders()
+	data := []byte("Host: localhost\nX-Injected: yes\r\n\r\n")
+	_, _, err := headers.Parse(data)
+	require.ErrorIs(t, err, ErrBareLineBreak)
+
+	data = []byte("Host: local\rhost\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrBareLineBreak)
+
+	// Test: an incomplete line that already holds a bare LF
+	data = []byte("Host: localhost\nX-Inj")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrBareLineBreak)
+}
+
+func TestRepeatedFieldsKeepOrderAndCasing(t *testing.T) {
+	headers := NewHeaders()
+	data := []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nX-Trace: one\r\nset-cookie: b=2\r\nX-Trace: two\r\n\r\n")
+	for {
+		n, done, err := headers.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, 4, headers.Len())
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, headers.Values("SET-COOKIE"))
+	assert.Equal(t, "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", value(headers, "set-cookie"))
+	assert.Equal(t, "one, two", value(headers, "x-trace"))
+	assert.Equal(t,
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nX-Trace: one\r\nset-cookie: b=2\r\nX-Trace: two\r\n\r\n",
+		headers.GetAsString())
+}
+
+func TestAddSetDel(t *testing.T) {
+	headers := NewHeaders()
+	headers.Add("Vary", "Accept")
+	headers.Add("Content-Type", "text/plain")
+	headers.Add("vary", "Accept-Encoding")
+	assert.Equal(t, []string{"Accept", "Accept-Encoding"}, headers.Values("Vary"))
+
+	// Test: Set keeps the position of the first field it replaces
+	headers.Set("VARY", "*")
+	assert.Equal(t, "VARY: *\r\nContent-Type: text/plain\r\n\r\n", headers.GetAsString())
+
+	// Test: Del and Remove ignore case
+	headers.Del("content-type")
+	headers.Remove("Vary")
+	assert.Equal(t, 0, headers.Len())
+	_, ok := headers.Get("vary")
+	assert.False(t, ok)
+
+	// Test: a nil set of fields reads as empty
+	var missing *Headers
+	assert.Nil(t, missing.Values("host"))
+	assert.Equal(t, "\r\n", missing.GetAsString())
+}
+
+func TestInvalidHeaderValueWithControlCharacter(t *testing.T) {
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("X-Name: a\x00b\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidHeaderValue)
+	_, _, err = headers.Parse([]byte("X-Name: a\x7fb\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidHeaderValue)
+
+	// Test: tabs and obs-text are allowed
+	n, _, err := headers.Parse([]byte("X-Name: a\tb \xe9\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 15, n)
+	assert.Equal(t, "a\tb \xe9", value(headers, "x-name"))
+}
+
+func TestValidateField(t *testing.T) {
+	require.NoError(t, ValidateField("X-Request-Id", "abc 123"))
+	require.ErrorIs(t, ValidateField("X Request", "abc"), ErrInvalidHeaderName)
+	require.ErrorIs(t, ValidateField("", "abc"), ErrInvalidHeaderName)
+	require.ErrorIs(t, ValidateField("Location", "/\r\nSet-Cookie: admin=1"), ErrInvalidHeaderValue)
+	require.ErrorIs(t, ValidateField("Location", "/\x00"), ErrInvalidHeaderValue)
+
+	headers := NewHeaders()
+	headers.Add("X-Ok", "fine")
+	headers.Add("X-Bad", "line\nbreak")
+	require.ErrorIs(t, headers.Validate(), ErrInvalidHeaderValue)
+}
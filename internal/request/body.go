@@ -0,0 +1,164 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MAX_DISCARD_SIZE is how much of an unread body ReadRequest is willing to
+// skip to reach the next request on the same stream.
+const MAX_DISCARD_SIZE = 256 << 10
+
+var (
+	ErrBodyTooLarge       = errors.New("body: request body exceeds the maximum allowed size")
+	ErrBodyReadAfterClose = errors.New("body: read after close")
+	ErrUnreadBody         = errors.New("body: previous request body was not consumed")
+)
+
+// NoBody is the Body of requests that do not carry one.
+var NoBody io.ReadCloser = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// body streams a request body by running the request state machine over the
+// Reader's buffer on demand, so only a buffer's worth of body is held in
+// memory at any time.
+type body struct {
+	reader  *Reader
+	request *Request
+	// offset is the read position in request.decoded.
+	offset int
+	read   int64
+	limit  int64
+	err    error
+	closed bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	return b.readDecoded(p)
+}
+
+// Close stops the handler from reading any further. Whatever is left of the
+// body is skipped by the next ReadRequest.
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *body) readDecoded(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	for b.offset == len(b.request.decoded) {
+		b.request.decoded = b.request.decoded[:0]
+		b.offset = 0
+		if b.request.isDone() {
+			b.err = io.EOF
+			return 0, b.err
+		}
+		err := b.reader.advance(b.request)
+		if err != nil {
+			b.err = err
+			return 0, err
+		}
+	}
+	if b.limit > 0 {
+		if b.read >= b.limit {
+			b.err = &LimitError{Err: ErrBodyTooLarge, Max: b.limit}
+			return 0, b.err
+		}
+		p = p[:min(int64(len(p)), b.limit-b.read)]
+	}
+	n := copy(p, b.request.decoded[b.offset:])
+	b.offset += n
+	b.read += int64(n)
+	return n, nil
+}
+
+// discard skips the rest of the body so the next request can be parsed.
+func (b *body) discard() error {
+	buffer := make([]byte, 512)
+	var discarded int64
+	for discarded <= MAX_DISCARD_SIZE {
+		n, err := b.readDecoded(buffer)
+		discarded += int64(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrUnreadBody, err)
+		}
+	}
+	return ErrUnreadBody
+}
+
+// unreadSize returns how much of the body is left, or false when that can't
+// be known without reading the rest of a chunked body.
+func (b *body) unreadSize() (int64, bool) {
+	if b.err != nil {
+		return 0, b.err == io.EOF
+	}
+	buffered := int64(len(b.request.decoded) - b.offset)
+	switch {
+	case b.request.isDone():
+		return buffered, true
+	case b.request.inChunkedBody():
+		return 0, false
+	}
+	return buffered + b.request.bodyRemaining, true
+}
+
+// CanSkipBody reports whether what is left of the body of the last request
+// is known to be small enough for the next ReadRequest to skip it.
+func (rd *Reader) CanSkipBody() bool {
+	if rd.current == nil {
+		return true
+	}
+	size, ok := rd.current.unreadSize()
+	return ok && size <= MAX_DISCARD_SIZE
+}
+
+// SkipBody skips what is left of the body of the last request, as the next
+// ReadRequest would. It fails with ErrUnreadBody when that is more than
+// MAX_DISCARD_SIZE, after which no further request can be read.
+func (rd *Reader) SkipBody() error {
+	if rd.current == nil {
+		return nil
+	}
+	if err := rd.current.discard(); err != nil {
+		return err
+	}
+	rd.current = nil
+	return nil
+}
+
+// advance makes progress on the body of request, parsing what is already
+// buffered and reading from the underlying stream when that is not enough.
+func (rd *Reader) advance(request *Request) error {
+	if rd.readIndex > 0 {
+		parsedCount, err := rd.parseBuffered(request)
+		if err != nil || parsedCount > 0 {
+			return err
+		}
+	}
+	readByteCount, err := rd.fill()
+	if readByteCount > 0 {
+		return nil
+	}
+	if err == io.EOF {
+		parseErr := &ParseError{Err: ErrBodyTooShort, Offset: request.consumed, Cause: io.ErrUnexpectedEOF}
+		if request.inChunkedBody() {
+			parseErr.Err = ErrMalformedChunk
+			parseErr.Detail = "stream ended before the terminating chunk"
+		}
+		return parseErr
+	}
+	return err
+}
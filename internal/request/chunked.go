@@ -0,0 +1,81 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"httpFromTCP/internal/headers"
+	"strconv"
+	"strings"
+)
+
+// stateChunkSizeMethod parses a chunk-size line such as "1a;name=value\r\n".
+// Chunk extensions are accepted but ignored. The line may be no longer than
+// a request line.
+func stateChunkSizeMethod(r *Request, data []byte) (int, error) {
+	separatorIndex := bytes.Index(data, []byte(SEPARATOR))
+	if separatorIndex > r.limits.MaxRequestLineBytes || (separatorIndex == -1 && len(data) > r.limits.MaxRequestLineBytes) {
+		return 0, newParseError(ErrMalformedChunk, fmt.Sprintf("chunk size line longer than %d bytes", r.limits.MaxRequestLineBytes))
+	}
+	if separatorIndex == -1 {
+		if hasBareLineBreak(string(data), false) {
+			return 0, newParseError(ErrBareLineBreak, "in chunk size line")
+		}
+		return 0, nil
+	}
+	line := string(data[:separatorIndex])
+	if hasBareLineBreak(line, true) {
+		return 0, newParseError(ErrBareLineBreak, "in chunk size line")
+	}
+	sizeStr, _, _ := strings.Cut(line, ";")
+	sizeStr = strings.TrimRight(sizeStr, " \t")
+	if sizeStr == "" {
+		return 0, newParseError(ErrMalformedChunk, "missing chunk size")
+	}
+	size, err := strconv.ParseUint(sizeStr, 16, 31)
+	if err != nil {
+		return 0, newParseError(ErrMalformedChunk, fmt.Sprintf("invalid chunk size %q", sizeStr))
+	}
+	if size == 0 {
+		r.Trailers = headers.NewHeaders()
+		// The trailer section gets the same budget as the header section.
+		r.headerCount = 0
+		r.headerBytes = 0
+		r.status = StateBodyDone
+	} else {
+		r.chunkRemaining = int(size)
+		r.status = StateChunkData
+	}
+	return separatorIndex + len(SEPARATOR), nil
+}
+
+// stateChunkDataMethod hands chunk data to the body and then consumes the
+// CRLF that closes the chunk.
+func stateChunkDataMethod(r *Request, data []byte) (int, error) {
+	if r.chunkRemaining > 0 {
+		parsableByteCount := min(r.chunkRemaining, len(data))
+		r.decoded = append(r.decoded, data[:parsableByteCount]...)
+		r.chunkRemaining -= parsableByteCount
+		return parsableByteCount, nil
+	}
+	if len(data) < len(SEPARATOR) {
+		return 0, nil
+	}
+	if !bytes.HasPrefix(data, []byte(SEPARATOR)) {
+		return 0, newParseError(ErrMalformedChunk, "chunk data is not followed by CRLF")
+	}
+	r.status = StateChunkSize
+	return len(SEPARATOR), nil
+}
+
+// stateTrailersMethod parses the trailer section that follows the last chunk,
+// which is bounded by the header limits.
+func stateTrailersMethod(r *Request, data []byte) (int, error) {
+	n, done, err := parseFieldSection(r, r.Trailers, data)
+	if err != nil {
+		return n, err
+	}
+	if done {
+		r.status = Done
+	}
+	return n, nil
+}
@@ -0,0 +1,110 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"httpFromTCP/internal/headers"
+)
+
+var (
+	ErrMalformedRequestLine = errors.New("request: malformed request line")
+	ErrUnsupportedVersion   = errors.New("request: unsupported HTTP version")
+	ErrIncompleteRequest    = errors.New("request: stream ended before the request head was complete")
+	ErrInvalidContentLength = errors.New("request: invalid content-length")
+	ErrMalformedChunk       = errors.New("body: malformed chunked body")
+	ErrBodyTooShort         = errors.New("body: content-length reported not matching actual")
+
+	ErrBareLineBreak               = errors.New("request: bare CR or LF is not allowed")
+	ErrObsFold                     = errors.New("request: obsolete line folding is not allowed")
+	ErrConflictingFraming          = errors.New("request: both Transfer-Encoding and Content-Length are present")
+	ErrInvalidTransferEncoding     = errors.New("request: invalid transfer-encoding")
+	ErrUnsupportedTransferEncoding = errors.New("request: unsupported transfer-encoding")
+)
+
+// ParseError describes a request that could not be parsed. Err is one of the
+// Err* sentinels of this package or of the headers package, Offset is where in
+// the request (counted from its first byte) parsing failed.
+type ParseError struct {
+	Err    error
+	Offset int64
+	Detail string
+	// Cause is the lower level error behind Err, if there is one.
+	Cause error
+}
+
+func newParseError(err error, detail string) *ParseError {
+	return &ParseError{Err: err, Detail: detail}
+}
+
+func (e *ParseError) Error() string {
+	message := fmt.Sprintf("%v at byte %d", e.Err, e.Offset)
+	if e.Detail != "" {
+		message += ": " + e.Detail
+	}
+	if e.Cause != nil {
+		message += ": " + e.Cause.Error()
+	}
+	return message
+}
+
+func (e *ParseError) Unwrap() []error {
+	if e.Cause == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.Cause}
+}
+
+// StatusCode is the HTTP status the server should answer with.
+func (e *ParseError) StatusCode() int {
+	var limitErr *LimitError
+	if errors.As(e.Err, &limitErr) {
+		return limitErr.StatusCode()
+	}
+	if errors.Is(e.Err, ErrUnsupportedVersion) {
+		return 505
+	}
+	if errors.Is(e.Err, ErrUnsupportedTransferEncoding) {
+		return 501
+	}
+	return 400
+}
+
+// Reason is a short description of the failure that is safe to send back to
+// the client.
+func (e *ParseError) Reason() string {
+	switch {
+	case errors.Is(e.Err, headers.ErrInvalidHeaderName):
+		return headers.ErrInvalidHeaderName.Error()
+	case errors.Is(e.Err, headers.ErrMalformedHeader):
+		return headers.ErrMalformedHeader.Error()
+	case errors.Is(e.Err, headers.ErrInvalidHeaderValue):
+		return headers.ErrInvalidHeaderValue.Error()
+	case errors.Is(e.Err, headers.ErrBareLineBreak):
+		return ErrBareLineBreak.Error()
+	}
+	return e.Err.Error()
+}
+
+// asParseError makes sure err carries the offset it happened at.
+func asParseError(err error, offset int64) error {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		parseErr.Offset += offset
+		return parseErr
+	}
+	return &ParseError{Err: err, Offset: offset}
+}
+
+// Reason maps an error returned while reading a request to a message that can
+// be sent to the client without leaking internal details.
+func Reason(err error) string {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		return parseErr.Reason()
+	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return limitErr.Error()
+	}
+	return "request: could not be parsed"
+}
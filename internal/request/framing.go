@@ -0,0 +1,105 @@
+package request
+
+import (
+	"fmt"
+	"httpFromTCP/internal/headers"
+	"strconv"
+	"strings"
+)
+
+// The rules in this file follow RFC 9112 section 6. Anything ambiguous about
+// where a message ends is rejected rather than guessed, because a proxy in
+// front of the server may guess differently and let a request be smuggled.
+
+// setBodyFraming decides how the body is delimited once the head is parsed.
+func (r *Request) setBodyFraming() error {
+	transferEncoding, hasTransferEncoding := r.Headers.Get(headers.TRANSFER_ENCODING)
+	contentLengthStr, hasContentLength := r.Headers.Get(headers.CONTENT_LENGTH)
+	if hasTransferEncoding {
+		if hasContentLength {
+			return newParseError(ErrConflictingFraming, "")
+		}
+		err := validateTransferEncoding(transferEncoding, r.RequestLine.HttpVersion)
+		if err != nil {
+			return err
+		}
+		r.ContentLength = -1
+		r.status = StateChunkSize
+		return nil
+	}
+	if !hasContentLength {
+		r.status = Done
+		return nil
+	}
+	contentLength, err := parseContentLength(contentLengthStr)
+	if err != nil {
+		return err
+	}
+	if r.limits.MaxBodyBytes > 0 && contentLength > r.limits.MaxBodyBytes {
+		return &LimitError{Err: ErrBodyTooLarge, Max: r.limits.MaxBodyBytes}
+	}
+	r.ContentLength = contentLength
+	r.bodyRemaining = contentLength
+	if contentLength > 0 {
+		r.status = StateBody
+	} else {
+		r.status = Done
+	}
+	return nil
+}
+
+// parseContentLength accepts nothing but a single run of digits. Repeated
+// Content-Length fields reach this point joined by commas and are rejected
+// even when the values agree.
+func parseContentLength(value string) (int64, error) {
+	if strings.Contains(value, ",") {
+		return 0, newParseError(ErrInvalidContentLength, fmt.Sprintf("repeated values %q", value))
+	}
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0, newParseError(ErrInvalidContentLength, fmt.Sprintf("%q is not a non-negative integer", value))
+	}
+	contentLength, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, newParseError(ErrInvalidContentLength, fmt.Sprintf("%q is out of range", value))
+	}
+	return contentLength, nil
+}
+
+// validateTransferEncoding only lets a lone "chunked" coding through, which
+// is the only one the server can decode.
+func validateTransferEncoding(value string, httpVersion string) error {
+	if httpVersion == "1.0" {
+		return newParseError(ErrInvalidTransferEncoding, "not allowed in HTTP/1.0")
+	}
+	codings := strings.Split(value, ",")
+	for i := range codings {
+		codings[i] = strings.ToLower(strings.TrimSpace(codings[i]))
+	}
+	if codings[len(codings)-1] != "chunked" {
+		return newParseError(ErrInvalidTransferEncoding, fmt.Sprintf("final coding of %q is not chunked", value))
+	}
+	if len(codings) > 1 {
+		return newParseError(ErrUnsupportedTransferEncoding, value)
+	}
+	return nil
+}
+
+// parseFieldLine parses one header or trailer line, refusing lines that
+// start with whitespace: that is either obs-fold continuing the previous
+// field or whitespace in front of the first field, and both are rejected.
+func parseFieldLine(h *headers.Headers, data []byte) (int, bool, error) {
+	if len(data) > 0 && (data[0] == ' ' || data[0] == '\t') {
+		return 0, false, newParseError(ErrObsFold, "")
+	}
+	return h.Parse(data)
+}
+
+// hasBareLineBreak reports whether a line that should end in CRLF contains a
+// CR or LF on its own. complete tells whether the CRLF was found, if not a
+// trailing CR may still be the start of it.
+func hasBareLineBreak(line string, complete bool) bool {
+	if !complete {
+		line = strings.TrimSuffix(line, "\r")
+	}
+	return strings.ContainsAny(line, "\r\n")
+}
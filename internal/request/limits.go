@@ -0,0 +1,83 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+)
+
+const DEFAULT_MAX_REQUEST_LINE_BYTES = 8 << 10
+const DEFAULT_MAX_HEADER_COUNT = 100
+const DEFAULT_MAX_HEADER_BYTES = 64 << 10
+
+var (
+	ErrRequestLineTooLong = errors.New("request: request line too long")
+	ErrTooManyHeaders     = errors.New("request: too many header fields")
+	ErrHeadersTooLarge    = errors.New("request: header section too large")
+)
+
+// Limits bounds the size of incoming requests. Zero values fall back to the
+// DEFAULT_* constants, except MaxBodyBytes where zero means no limit.
+type Limits struct {
+	MaxRequestLineBytes int
+	MaxHeaderCount      int
+	MaxHeaderBytes      int
+	MaxBodyBytes        int64
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLineBytes <= 0 {
+		l.MaxRequestLineBytes = DEFAULT_MAX_REQUEST_LINE_BYTES
+	}
+	if l.MaxHeaderCount <= 0 {
+		l.MaxHeaderCount = DEFAULT_MAX_HEADER_COUNT
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DEFAULT_MAX_HEADER_BYTES
+	}
+	return l
+}
+
+// maxBufferSize is how large the parse buffer may grow: enough to hold the
+// longest allowed line of the request head together with its CRLF.
+func (l Limits) maxBufferSize() int {
+	return max(l.MaxRequestLineBytes, l.MaxHeaderBytes) + len(SEPARATOR)
+}
+
+// LimitError reports a request exceeding one of the configured Limits. It
+// wraps one of ErrRequestLineTooLong, ErrTooManyHeaders, ErrHeadersTooLarge
+// or ErrBodyTooLarge.
+type LimitError struct {
+	Err error
+	Max int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v (limit %d)", e.Err, e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode is the HTTP status the server should answer with.
+func (e *LimitError) StatusCode() int {
+	switch e.Err {
+	case ErrRequestLineTooLong:
+		return 414
+	case ErrTooManyHeaders, ErrHeadersTooLarge:
+		return 431
+	case ErrBodyTooLarge:
+		return 413
+	}
+	return 400
+}
+
+// StatusCode maps an error returned while reading a request to the HTTP
+// status the server should answer with.
+func StatusCode(err error) int {
+	var coder interface{ StatusCode() int }
+	if errors.As(err, &coder) {
+		return coder.StatusCode()
+	}
+	return 400
+}
@@ -1,12 +1,12 @@
 package request
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"httpFromTCP/internal/headers"
 	"io"
 	"regexp"
-	"strconv"
 	"strings"
 )
 
@@ -14,24 +14,53 @@ type RequestState string
 
 const SEPARATOR = "\r\n" // CRLF is the separator
 const INITIAL_BUFFER_SIZE = 1
-const MAX_BUFFER_SIZE = 1024
 const (
 	Initialized      RequestState = "INITIALIZED"
 	StateRequestLine RequestState = "STATE_REQUEST_LINE"
 	StateHeaders     RequestState = "STATE_HEADERS"
 	StateHeadersDone RequestState = " STATE_HEADERS_DONE"
 	StateBody        RequestState = "STATE_BODY"
+	StateChunkSize   RequestState = "STATE_CHUNK_SIZE"
+	StateChunkData   RequestState = "STATE_CHUNK_DATA"
 	StateBodyDone    RequestState = "STATE_BODY_DONE"
 	Done             RequestState = "DONE"
 )
 
 var httpVersionRegexMatch = regexp.MustCompile(`^HTTP/\d+(?:\.\d+)?$`)
+var methodRegexMatch = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+\\-.^_`|~]+$")
 
 type Request struct {
 	RequestLine RequestLine
-	Headers     headers.Headers
-	Body        []byte
-	status      RequestState
+	// URL is the parsed RequestLine.RequestTarget.
+	URL     *URL
+	Headers *headers.Headers
+	// Body streams the request body from the connection. It is never nil,
+	// requests without a body get NoBody.
+	Body io.ReadCloser
+	// ContentLength is the declared body size, or -1 for a chunked body.
+	ContentLength int64
+	// Trailers holds the trailer fields sent after a chunked body. It is only
+	// populated once Body has been read to the end.
+	Trailers *headers.Headers
+	status   RequestState
+	// bodyRemaining counts the bytes left in a Content-Length framed body.
+	bodyRemaining int64
+	// chunkRemaining counts the data bytes left in the current chunk.
+	chunkRemaining int
+	limits         Limits
+	headerCount    int
+	headerBytes    int
+	// consumed counts the bytes of this request parsed so far.
+	consumed int64
+	// decoded holds body bytes produced by the last parse that have not been
+	// handed to Body's reader yet.
+	decoded []byte
+	// TLS describes the connection the request arrived on when it was served
+	// over TLS, and is nil otherwise.
+	TLS *tls.ConnectionState
+	// pathValues holds the wildcards matched by a router.
+	pathValues map[string]string
+	ctx        context.Context
 }
 
 type RequestLine struct {
@@ -44,86 +73,212 @@ func (r *Request) isDone() bool {
 	return r.status == Done
 }
 
-func (r *Request) isValidContentLength() error {
-	if !r.isDone() {
-		return fmt.Errorf("body: content length check done before body parsing completion")
+func (r *Request) headersParsed() bool {
+	switch r.status {
+	case StateBody, StateChunkSize, StateChunkData, StateBodyDone, Done:
+		return true
 	}
-	contentLengthStr, ok := r.Headers.Get(headers.CONTENT_LENGTH)
-	if !ok {
-		return nil
-	}
-	contentLength, err := strconv.Atoi(contentLengthStr)
-	if err != nil {
-		return fmt.Errorf("body: %w", err)
-	}
-	if contentLength != len(r.Body) {
-		return fmt.Errorf("body: content-length reported not matching actual")
+	return false
+}
+
+func (r *Request) inChunkedBody() bool {
+	switch r.status {
+	case StateChunkSize, StateChunkData, StateBodyDone:
+		return true
 	}
-	return nil
+	return false
 }
 
-func (r *Request) getContentLength() (int, error) {
-	contentLengthStr, ok := r.Headers.Get(headers.CONTENT_LENGTH)
+// IsChunked reports whether the request body uses the chunked transfer coding.
+func (r *Request) IsChunked() bool {
+	transferEncoding, ok := r.Headers.Get(headers.TRANSFER_ENCODING)
 	if !ok {
-		return 0, nil
-	}
-	contentLength, err := strconv.Atoi(contentLengthStr)
-	if err != nil {
-		return 0, err
+		return false
 	}
-	return contentLength, nil
+	codings := strings.Split(transferEncoding, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
 }
-func newInitializedRequest() *Request {
-	return &Request{status: Initialized}
+
+func newInitializedRequest(limits Limits) *Request {
+	return &Request{status: Initialized, limits: limits}
 }
 
-func RequestFromReader(r io.Reader) (Request, error) {
-	bufferSize := INITIAL_BUFFER_SIZE
-
-	buffer := make([]byte, bufferSize)
-	request := newInitializedRequest()
-	readIndex := 0
-	for !request.isDone() {
-		if readIndex == bufferSize {
-			increasedBuffer, increasedBufferSize, err := increaseBufferSize(buffer, MAX_BUFFER_SIZE)
-			buffer = increasedBuffer
-			bufferSize = increasedBufferSize
-			if err != nil {
-				return Request{}, err
-			}
+// Reader parses consecutive requests from a single stream. Bytes read past
+// the end of one request are kept for the next call to ReadRequest, which is
+// what makes pipelined requests on a persistent connection work.
+type Reader struct {
+	r         io.Reader
+	buffer    []byte
+	readIndex int
+
+	// Limits bounds the size of every request read. Exceeding one of them
+	// fails with a *LimitError.
+	Limits Limits
+
+	// current is the body of the last request, which has to be consumed
+	// before the next request can be parsed.
+	current *body
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, buffer: make([]byte, INITIAL_BUFFER_SIZE)}
+}
+
+func RequestFromReader(r io.Reader) (*Request, error) {
+	return NewReader(r).ReadRequest()
+}
+
+// WaitForRequest blocks until at least one byte of the next request is
+// available, without parsing anything. It returns io.EOF when the stream
+// ends first.
+func (rd *Reader) WaitForRequest() error {
+	for rd.readIndex == 0 {
+		readByteCount, err := rd.r.Read(rd.buffer)
+		rd.readIndex += readByteCount
+		if readByteCount == 0 && err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRequest parses the head of the next request and returns as soon as it
+// is complete, leaving the body to be streamed through Request.Body. Any body
+// left unread from the previous request is discarded first. It returns io.EOF
+// when the stream ends cleanly before any byte of a new request was received.
+func (rd *Reader) ReadRequest() (*Request, error) {
+	if rd.current != nil {
+		err := rd.current.discard()
+		rd.current = nil
+		if err != nil {
+			return nil, err
 		}
-		readByteCount, err := r.Read(buffer[readIndex:])
+	}
+	request := newInitializedRequest(rd.Limits.withDefaults())
+	if rd.readIndex > 0 {
+		_, err := rd.parseBuffered(request)
 		if err != nil {
-			if err == io.EOF {
-				request.status = Done
-				break
+			return nil, err
+		}
+	}
+	for !request.headersParsed() {
+		readByteCount, err := rd.fill()
+		if readByteCount > 0 {
+			_, parseErr := rd.parseBuffered(request)
+			if parseErr != nil {
+				return nil, parseErr
 			}
-			return Request{}, err
+			continue
+		}
+		if err == io.EOF {
+			if request.status == Initialized && rd.readIndex == 0 {
+				return nil, io.EOF
+			}
+			return nil, &ParseError{Err: ErrIncompleteRequest, Offset: request.consumed + int64(rd.readIndex), Cause: io.ErrUnexpectedEOF}
 		}
-		readIndex += readByteCount
-		parsedCount, err := request.parse(buffer[:readIndex])
 		if err != nil {
-			return Request{}, err
+			return nil, err
 		}
-		if parsedCount != 0 {
-			remainingUnparsedBytes := readIndex - parsedCount
-			copy(buffer, buffer[parsedCount:readIndex])
-			readIndex = remainingUnparsedBytes
+	}
+
+	if request.isDone() {
+		request.Body = NoBody
+	} else {
+		rd.current = &body{reader: rd, request: request, limit: request.limits.MaxBodyBytes}
+		request.Body = rd.current
+	}
+	return request, nil
+}
+
+// fill reads more bytes from the underlying stream into the buffer, growing
+// the buffer when it is full.
+func (rd *Reader) fill() (int, error) {
+	if rd.readIndex == len(rd.buffer) {
+		increasedBuffer, _, err := increaseBufferSize(rd.buffer, rd.Limits.withDefaults().maxBufferSize())
+		rd.buffer = increasedBuffer
+		if err != nil {
+			return 0, err
 		}
 	}
+	readByteCount, err := rd.r.Read(rd.buffer[rd.readIndex:])
+	rd.readIndex += readByteCount
+	return readByteCount, err
+}
+
+func (rd *Reader) parseBuffered(request *Request) (int, error) {
+	parsedCount, err := request.parse(rd.buffer[:rd.readIndex])
+	if err != nil {
+		return 0, asParseError(err, request.consumed+int64(parsedCount))
+	}
+	request.consumed += int64(parsedCount)
+	if parsedCount != 0 {
+		remainingUnparsedBytes := rd.readIndex - parsedCount
+		copy(rd.buffer, rd.buffer[parsedCount:rd.readIndex])
+		rd.readIndex = remainingUnparsedBytes
+	}
+	return parsedCount, nil
+}
 
-	err := request.isValidContentLength()
+// KeepAlive reports whether the client expects the connection to stay open
+// after this request. HTTP/1.1 defaults to persistent connections while
+// HTTP/1.0 needs an explicit "Connection: keep-alive".
+func (r *Request) KeepAlive() bool {
+	connection, _ := r.Headers.Get(headers.CONNECTION)
+	if headers.HasToken(connection, "close") {
+		return false
+	}
+	if r.RequestLine.HttpVersion == "1.0" {
+		return headers.HasToken(connection, "keep-alive")
+	}
+	return true
+}
+
+// Context returns the context of the request. It is never nil, requests
+// that were not given one have context.Background. The server cancels it
+// when the client goes away, a timeout fires or the server shuts down.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// which is how middleware attaches values to a request.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
 
-	return *request, err
+// PathValue returns the value a router matched for the named wildcard of the
+// route pattern, or "" when there is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue sets the value returned by PathValue for name.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
 }
 
 func extractVersion(versionStr string) (string, error) {
 	matchesFormat := httpVersionRegexMatch.MatchString(versionStr)
 	if !matchesFormat {
-		return "", errors.New("http version: does not match expected pattern of")
+		return "", newParseError(ErrMalformedRequestLine, fmt.Sprintf("http version %q does not match HTTP/x.y", versionStr))
 	}
 	parts := strings.Split(versionStr, "/")
 	versionNumberStr := parts[1]
+	if versionNumberStr != "1.1" && versionNumberStr != "1.0" {
+		return "", newParseError(ErrUnsupportedVersion, versionStr)
+	}
 	return versionNumberStr, nil
 }
 
@@ -138,7 +293,7 @@ func (r *Request) parse(data []byte) (int, error) {
 		case Initialized, StateRequestLine:
 			n, err := initializedStateMethod(r, remainingData)
 			if err != nil {
-				return totalBytesParsed, err
+				return totalBytesParsed + n, err
 			}
 			if n == 0 {
 				return totalBytesParsed, nil
@@ -149,24 +304,61 @@ func (r *Request) parse(data []byte) (int, error) {
 		case StateHeaders:
 			n, err := stateHeadersMethod(r, remainingData)
 			if err != nil {
-				return totalBytesParsed, err
+				return totalBytesParsed + n, err
 			}
 			if n == 0 {
 				return totalBytesParsed, nil
 			}
 			totalBytesParsed += n
 			remainingData = remainingData[n:]
+			if r.headersParsed() {
+				// The body is parsed on demand when Body is read.
+				return totalBytesParsed, nil
+			}
 
 		case StateBody:
 			n, err := stateBodyMethod(r, remainingData)
 			if err != nil {
-				return totalBytesParsed, err
+				return totalBytesParsed + n, err
 			}
 			totalBytesParsed += n
 			return totalBytesParsed, nil
 
+		case StateChunkSize:
+			n, err := stateChunkSizeMethod(r, remainingData)
+			if err != nil {
+				return totalBytesParsed + n, err
+			}
+			if n == 0 {
+				return totalBytesParsed, nil
+			}
+			totalBytesParsed += n
+			remainingData = remainingData[n:]
+
+		case StateChunkData:
+			n, err := stateChunkDataMethod(r, remainingData)
+			if err != nil {
+				return totalBytesParsed + n, err
+			}
+			if n == 0 {
+				return totalBytesParsed, nil
+			}
+			totalBytesParsed += n
+			remainingData = remainingData[n:]
+
+		case StateBodyDone:
+			n, err := stateTrailersMethod(r, remainingData)
+			if err != nil {
+				return totalBytesParsed + n, err
+			}
+			if n == 0 {
+				return totalBytesParsed, nil
+			}
+			totalBytesParsed += n
+			remainingData = remainingData[n:]
+
 		default:
-			return totalBytesParsed, fmt.Errorf("unknown state when parsing request")
+			return totalBytesParsed, fmt.Errorf("request: unknown state %q when parsing request", r.status)
 		}
 
 		if len(remainingData) == 0 {
@@ -177,6 +369,10 @@ func (r *Request) parse(data []byte) (int, error) {
 
 func initializedStateMethod(r *Request, data []byte) (int, error) {
 	bytesParsed, requestLine, err := parseRequestLine(string(data))
+	maxLineLength := r.limits.MaxRequestLineBytes + len(SEPARATOR)
+	if bytesParsed > maxLineLength || (bytesParsed == 0 && len(data) >= maxLineLength) {
+		return 0, &LimitError{Err: ErrRequestLineTooLong, Max: int64(r.limits.MaxRequestLineBytes)}
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -184,7 +380,13 @@ func initializedStateMethod(r *Request, data []byte) (int, error) {
 		return 0, nil
 	}
 
+	url, err := parseRequestTarget(requestLine.Method, requestLine.RequestTarget)
+	if err != nil {
+		// Point the error offset at the target.
+		return len(requestLine.Method) + 1, err
+	}
 	r.RequestLine = *requestLine
+	r.URL = url
 	r.Headers = headers.NewHeaders()
 	r.status = StateHeaders
 	return bytesParsed, nil
@@ -192,77 +394,92 @@ func initializedStateMethod(r *Request, data []byte) (int, error) {
 }
 
 func stateHeadersMethod(r *Request, data []byte) (int, error) {
+	n, done, err := parseFieldSection(r, r.Headers, data)
+	if err != nil || !done {
+		return n, err
+	}
+	return n, r.setBodyFraming()
+}
+
+// parseFieldSection parses the field lines of a header or trailer section
+// into fields, counting them against the header limits. It reports done
+// once the empty line closing the section has been parsed.
+func parseFieldSection(r *Request, fields *headers.Headers, data []byte) (int, bool, error) {
 	totalBytesParsed := 0
 	remainingData := data
 
 	for {
-		n, done, err := r.Headers.Parse(remainingData)
+		n, done, err := parseFieldLine(fields, remainingData)
 		if err != nil {
-			return totalBytesParsed, err
+			return totalBytesParsed, false, err
 		}
 
+		r.headerBytes += n
+		if r.headerBytes > r.limits.MaxHeaderBytes || (n == 0 && r.headerBytes+len(remainingData) > r.limits.MaxHeaderBytes) {
+			return totalBytesParsed, false, &LimitError{Err: ErrHeadersTooLarge, Max: int64(r.limits.MaxHeaderBytes)}
+		}
 		if n == 0 {
-			return totalBytesParsed, nil
+			return totalBytesParsed, false, nil
 		}
 
 		totalBytesParsed += n
 		remainingData = remainingData[n:]
 
 		if done {
-			_, ok := r.Headers.Get(headers.CONTENT_LENGTH)
-			if ok {
-				r.status = StateBody
-			} else {
-				r.status = Done
-			}
-			return totalBytesParsed, nil
+			return totalBytesParsed, true, nil
+		}
+		r.headerCount++
+		if r.headerCount > r.limits.MaxHeaderCount {
+			return totalBytesParsed, false, &LimitError{Err: ErrTooManyHeaders, Max: int64(r.limits.MaxHeaderCount)}
 		}
 
 		if len(remainingData) == 0 {
-			return totalBytesParsed, nil
+			return totalBytesParsed, false, nil
 		}
 	}
 }
 
 func stateBodyMethod(r *Request, data []byte) (int, error) {
-	contentLength, err := r.getContentLength()
-	if err != nil {
-		return 0, err
-	}
-	bytesNeeded := contentLength - len(r.Body)
-	if bytesNeeded <= 0 {
-		r.status = Done
-		return 0, nil
-	}
-	parsableByteCount := min(bytesNeeded, len(data))
-	r.Body = append(r.Body, data[:parsableByteCount]...)
-	if len(r.Body) == contentLength {
+	parsableByteCount := int(min(r.bodyRemaining, int64(len(data))))
+	r.decoded = append(r.decoded, data[:parsableByteCount]...)
+	r.bodyRemaining -= int64(parsableByteCount)
+	if r.bodyRemaining == 0 {
 		r.status = Done
 	}
-	return len(data), err
+	return parsableByteCount, nil
 }
 
 func increaseBufferSize(currentBuffer []byte, maxBufferSize int) ([]byte, int, error) {
 	if len(currentBuffer) == maxBufferSize {
 		return currentBuffer, maxBufferSize, fmt.Errorf("maximum buffer size of %v reached", maxBufferSize)
 	}
-	tmpBuffer := make([]byte, 2*len(currentBuffer))
+	increasedSize := min(2*len(currentBuffer), maxBufferSize)
+	tmpBuffer := make([]byte, increasedSize)
 	copy(tmpBuffer, currentBuffer)
 
-	return tmpBuffer, 2 * len(currentBuffer), nil
+	return tmpBuffer, increasedSize, nil
 }
 
 func parseRequestLine(requestStr string) (int, *RequestLine, error) {
 	separatorIndex := strings.Index(requestStr, SEPARATOR)
 	if separatorIndex == -1 {
+		if hasBareLineBreak(requestStr, false) {
+			return 0, &RequestLine{}, newParseError(ErrBareLineBreak, "in request line")
+		}
 		return 0, nil, nil
 	}
 	requestLineStr := requestStr[:separatorIndex]
+	if hasBareLineBreak(requestLineStr, true) {
+		return 0, &RequestLine{}, newParseError(ErrBareLineBreak, "in request line")
+	}
 	parts := strings.Split(requestLineStr, " ")
 	if len(parts) != 3 {
-		return 0, &RequestLine{}, errors.New("number of parts in request line must be 3")
+		return 0, &RequestLine{}, newParseError(ErrMalformedRequestLine, "number of parts in request line must be 3")
 	}
 	method := parts[0]
+	if !methodRegexMatch.MatchString(method) {
+		return 0, &RequestLine{}, newParseError(ErrMalformedRequestLine, fmt.Sprintf("invalid method %q", method))
+	}
 	resource := parts[1]
 	version, err := extractVersion(parts[2])
 	totalReadBytes := len(requestLineStr) + len(SEPARATOR)
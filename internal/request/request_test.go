@@ -1,6 +1,8 @@
 package request
 
 import (
+	"context"
+	"httpFromTCP/internal/headers"
 	"io"
 	"strings"
 	"testing"
@@ -26,6 +28,13 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+func readBody(t *testing.T, r *Request) string {
+	t.Helper()
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
 func TestRequestFromReader(t *testing.T) {
 	// Test: Good GET Request line
 	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
@@ -87,9 +96,9 @@ func TestGoodRequestHeaders(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers.Values("user-agent"))
+	assert.Equal(t, []string{"*/*"}, r.Headers.Values("accept"))
 }
 
 func TestBadHeaders(t *testing.T) {
@@ -114,7 +123,7 @@ func TestBodyParsing(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "hello world!\n", readBody(t, r))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -126,6 +135,8 @@ func TestBodyParsing(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
 	require.Error(t, err)
 }
 
@@ -141,8 +152,8 @@ func TestBodyParsingWithEmptyBodyAndNoContentLength(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Empty(t, r.Body)
-	assert.Equal(t, "0", r.Headers["content-length"])
+	assert.Empty(t, readBody(t, r))
+	assert.Equal(t, []string{"0"}, r.Headers.Values("content-length"))
 
 }
 
@@ -157,7 +168,7 @@ func TestBodyParsingWithEmptyBodyAndNoReportedContentLength(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Empty(t, r.Body)
+	assert.Empty(t, readBody(t, r))
 	_, hasContentLength := r.Headers.Get("content-length")
 	assert.False(t, hasContentLength)
 }
@@ -171,7 +182,9 @@ func TestBodyParsingWithBodyShorterThanContentLength(t *testing.T) {
 			"only 15 bytes here",
 		numBytesPerRead: 3,
 	}
-	_, err := RequestFromReader(reader)
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "content-length reported not matching actual")
 }
@@ -187,7 +200,476 @@ func TestBodyWithNoContentLengthButBodyExist(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Empty(t, r.Body)
+	assert.Empty(t, readBody(t, r))
 	_, hasContentLength := r.Headers.Get("content-length")
 	assert.False(t, hasContentLength)
 }
+
+func TestPipelinedRequests(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Empty(t, readBody(t, r))
+
+	// Test: clean end of stream between requests
+	_, err = reader.ReadRequest()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestKeepAlive(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nConnection: Close\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+}
+
+func TestChunkedBodyParsing(t *testing.T) {
+	// Test: chunks with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7;note=\"ext\"\r\n, world\r\n" +
+			"0\r\n" +
+			"Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", readBody(t, r))
+	checksum, ok := r.Trailers.Get("checksum")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", checksum)
+
+	// Test: empty chunked body without trailers
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, readBody(t, r))
+
+	// Test: invalid chunk size
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.Error(t, err)
+
+	// Test: chunk data longer than its declared size
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.Error(t, err)
+
+	// Test: stream ends before the terminating chunk
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: a chunk size line is bounded like the request line, whether or
+	// not its end has arrived
+	for _, line := range []string{"5;ext=" + strings.Repeat("x", 70<<10), "5;ext=" + strings.Repeat("x", 70<<10) + "\r\nhello\r\n0\r\n\r\n"} {
+		r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + line))
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.Body)
+		var parseErr *ParseError
+		require.ErrorAs(t, err, &parseErr)
+		assert.ErrorIs(t, err, ErrMalformedChunk)
+		assert.Equal(t, 400, StatusCode(err))
+	}
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=" + strings.Repeat("x", 1000) + "\r\nhello\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+}
+
+func TestChunkedBodyFollowedByPipelinedRequest(t *testing.T) {
+	reader := NewReader(strings.NewReader("POST /first HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n0\r\n\r\n" +
+		"GET /second HTTP/1.1\r\n\r\n"))
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", readBody(t, r))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+}
+
+func TestBodyIsStreamed(t *testing.T) {
+	// Test: a body far larger than the parse buffer
+	largeBody := strings.Repeat("0123456789", 100_000)
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 1000000\r\n" +
+			"\r\n" +
+			largeBody,
+		numBytesPerRead: 4096,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1_000_000), r.ContentLength)
+	assert.Equal(t, largeBody, readBody(t, r))
+
+	// Test: a chunked body read past the configured maximum
+	limited := NewReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\na\r\n0123456789\r\n0\r\n\r\n"))
+	limited.Limits.MaxBodyBytes = 4
+	r, err = limited.ReadRequest()
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Equal(t, "0123", string(body))
+
+	// Test: a body exactly at the maximum
+	limited = NewReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\n0123"))
+	limited.Limits.MaxBodyBytes = 4
+	r, err = limited.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "0123", readBody(t, r))
+}
+
+func TestUnreadBodyIsSkipped(t *testing.T) {
+	reader := NewReader(strings.NewReader("POST /first HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /second HTTP/1.1\r\n\r\n"))
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	r.Body.Close()
+	_, err = r.Body.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrBodyReadAfterClose)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+}
+
+func TestRequestLimits(t *testing.T) {
+	readWithLimits := func(data string, limits Limits) error {
+		reader := NewReader(strings.NewReader(data))
+		reader.Limits = limits
+		_, err := reader.ReadRequest()
+		return err
+	}
+
+	// Test: request line longer than allowed
+	err := readWithLimits("GET /"+strings.Repeat("a", 64)+" HTTP/1.1\r\n\r\n", Limits{MaxRequestLineBytes: 32})
+	require.ErrorIs(t, err, ErrRequestLineTooLong)
+	assert.Equal(t, 414, StatusCode(err))
+
+	// Test: request line without CRLF that already exceeds the limit
+	err = readWithLimits("GET /"+strings.Repeat("a", 64), Limits{MaxRequestLineBytes: 32})
+	require.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: too many header fields
+	err = readWithLimits("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", Limits{MaxHeaderCount: 2})
+	require.ErrorIs(t, err, ErrTooManyHeaders)
+	assert.Equal(t, 431, StatusCode(err))
+
+	// Test: header section larger than allowed
+	err = readWithLimits("GET / HTTP/1.1\r\nCookie: "+strings.Repeat("c", 100)+"\r\n\r\n", Limits{MaxHeaderBytes: 64})
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+	assert.Equal(t, 431, StatusCode(err))
+
+	// Test: declared body larger than allowed
+	err = readWithLimits("POST / HTTP/1.1\r\nContent-Length: 100\r\n\r\n", Limits{MaxBodyBytes: 10})
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Equal(t, 413, StatusCode(err))
+
+	// Test: the trailer section is bounded like the header section
+	readTrailers := func(trailers string, limits Limits) error {
+		reader := NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n" + trailers + "\r\n"))
+		reader.Limits = limits
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.Body)
+		return err
+	}
+	err = readTrailers(strings.Repeat("X-A: 1\r\n", 6), Limits{MaxHeaderCount: 5})
+	require.ErrorIs(t, err, ErrTooManyHeaders)
+	assert.Equal(t, 431, StatusCode(err))
+	err = readTrailers("X-A: "+strings.Repeat("a", 100)+"\r\n", Limits{MaxHeaderBytes: 64})
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+	err = readTrailers(strings.Repeat("X-A: 1\r\n", 5), Limits{MaxHeaderCount: 5})
+	require.NoError(t, err)
+
+	// Test: everything within the defaults
+	err = readWithLimits("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", Limits{})
+	require.NoError(t, err)
+}
+
+func TestParseErrors(t *testing.T) {
+	parse := func(data string) (*Request, *ParseError) {
+		r, err := RequestFromReader(strings.NewReader(data))
+		if err == nil {
+			_, err = io.ReadAll(r.Body)
+		}
+		var parseErr *ParseError
+		require.ErrorAs(t, err, &parseErr)
+		return r, parseErr
+	}
+
+	// Test: malformed request line
+	_, err := parse("GET /coffee\r\n\r\n")
+	assert.ErrorIs(t, err, ErrMalformedRequestLine)
+	assert.Equal(t, 400, err.StatusCode())
+	assert.Equal(t, int64(0), err.Offset)
+
+	// Test: invalid method token
+	_, err = parse("G(T / HTTP/1.1\r\n\r\n")
+	assert.ErrorIs(t, err, ErrMalformedRequestLine)
+
+	// Test: well formed but unsupported version
+	_, err = parse("GET / HTTP/2.0\r\n\r\n")
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	assert.Equal(t, 505, err.StatusCode())
+
+	// Test: invalid header name points at the offending line
+	_, err = parse("GET / HTTP/1.1\r\nHost: localhost\r\nBad@Name: x\r\n\r\n")
+	assert.ErrorIs(t, err, headers.ErrInvalidHeaderName)
+	assert.Equal(t, int64(33), err.Offset)
+	assert.Equal(t, headers.ErrInvalidHeaderName.Error(), err.Reason())
+
+	// Test: content-length that is not a number
+	_, err = parse("POST / HTTP/1.1\r\nContent-Length: ten\r\n\r\n")
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+	assert.Equal(t, ErrInvalidContentLength.Error(), err.Reason())
+
+	// Test: body shorter than declared
+	_, err = parse("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc")
+	assert.ErrorIs(t, err, ErrBodyTooShort)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, int64(42), err.Offset)
+
+	// Test: stream ends in the middle of the head
+	_, err = parse("GET / HTTP/1.1\r\nHost: loc")
+	assert.ErrorIs(t, err, ErrIncompleteRequest)
+
+	// Test: limit errors keep their own status
+	reader := NewReader(strings.NewReader("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\n\r\n"))
+	reader.Limits.MaxHeaderCount = 1
+	_, readErr := reader.ReadRequest()
+	assert.ErrorIs(t, readErr, ErrTooManyHeaders)
+	assert.Equal(t, 431, StatusCode(readErr))
+}
+
+func TestFramingRules(t *testing.T) {
+	cases := map[string]struct {
+		data   string
+		err    error
+		status int
+	}{
+		"duplicate identical content-length": {
+			"POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", ErrInvalidContentLength, 400,
+		},
+		"conflicting content-length": {
+			"POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 10\r\n\r\nhello", ErrInvalidContentLength, 400,
+		},
+		"comma separated content-length": {
+			"POST / HTTP/1.1\r\nContent-Length: 5, 10\r\n\r\nhello", ErrInvalidContentLength, 400,
+		},
+		"negative content-length": {
+			"POST / HTTP/1.1\r\nContent-Length: -5\r\n\r\nhello", ErrInvalidContentLength, 400,
+		},
+		"signed content-length": {
+			"POST / HTTP/1.1\r\nContent-Length: +5\r\n\r\nhello", ErrInvalidContentLength, 400,
+		},
+		"hex content-length": {
+			"POST / HTTP/1.1\r\nContent-Length: 0x5\r\n\r\nhello", ErrInvalidContentLength, 400,
+		},
+		"empty content-length": {
+			"POST / HTTP/1.1\r\nContent-Length:\r\n\r\n", ErrInvalidContentLength, 400,
+		},
+		"overflowing content-length": {
+			"POST / HTTP/1.1\r\nContent-Length: 99999999999999999999\r\n\r\n", ErrInvalidContentLength, 400,
+		},
+		"transfer-encoding with content-length": {
+			"POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrConflictingFraming, 400,
+		},
+		"content-length with transfer-encoding": {
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n", ErrConflictingFraming, 400,
+		},
+		"final coding not chunked": {
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n", ErrInvalidTransferEncoding, 400,
+		},
+		"unknown coding only": {
+			"POST / HTTP/1.1\r\nTransfer-Encoding: identity\r\n\r\n", ErrInvalidTransferEncoding, 400,
+		},
+		"chunked applied twice": {
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrUnsupportedTransferEncoding, 501,
+		},
+		"coding before chunked": {
+			"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", ErrUnsupportedTransferEncoding, 501,
+		},
+		"transfer-encoding in HTTP/1.0": {
+			"POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding, 400,
+		},
+		"obs-fold": {
+			"GET / HTTP/1.1\r\nX-Folded: first\r\n  second\r\n\r\n", ErrObsFold, 400,
+		},
+		"whitespace before first header": {
+			"GET / HTTP/1.1\r\n Host: localhost\r\n\r\n", ErrObsFold, 400,
+		},
+		"obs-fold in trailers": {
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Trailer: a\r\n\tb\r\n\r\n", ErrObsFold, 400,
+		},
+		"bare LF in request line": {
+			"GET / HTTP/1.1\nHost: localhost\r\n\r\n", ErrBareLineBreak, 400,
+		},
+		"bare CR in request line": {
+			"GET /\r HTTP/1.1\r\n\r\n", ErrBareLineBreak, 400,
+		},
+		"bare LF in header": {
+			"GET / HTTP/1.1\r\nHost: localhost\nX-Smuggled: yes\r\n\r\n", headers.ErrBareLineBreak, 400,
+		},
+		"bare CR in header": {
+			"GET / HTTP/1.1\r\nHost: local\rhost\r\n\r\n", headers.ErrBareLineBreak, 400,
+		},
+		"bare LF line endings": {
+			"GET / HTTP/1.1\nHost: localhost\n\n", ErrBareLineBreak, 400,
+		},
+		"bare LF in chunk size": {
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\nhello\r\n0\r\n\r\n", ErrBareLineBreak, 400,
+		},
+		"space before colon": {
+			"GET / HTTP/1.1\r\nContent-Length : 5\r\n\r\nhello", headers.ErrInvalidHeaderName, 400,
+		},
+		"tab before colon": {
+			"GET / HTTP/1.1\r\nContent-Length\t: 5\r\n\r\nhello", headers.ErrInvalidHeaderName, 400,
+		},
+		"NUL in header value": {
+			"GET / HTTP/1.1\r\nX-Name: a\x00b\r\n\r\n", headers.ErrInvalidHeaderValue, 400,
+		},
+		"control character in trailer value": {
+			"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Trailer: a\x1bb\r\n\r\n", headers.ErrInvalidHeaderValue, 400,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := RequestFromReader(strings.NewReader(c.data))
+			if err == nil {
+				_, err = io.ReadAll(r.Body)
+			}
+			require.ErrorIs(t, err, c.err)
+			assert.Equal(t, c.status, StatusCode(err))
+		})
+	}
+
+	// Test: a single valid content-length still works
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 005\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+}
+
+func TestRequestTarget(t *testing.T) {
+	parse := func(requestLine string) (*Request, error) {
+		return RequestFromReader(strings.NewReader(requestLine + "\r\nHost: localhost\r\n\r\n"))
+	}
+
+	// Test: origin form with a decoded path and a multi-valued query
+	r, err := parse("GET /video/my%20clip%2Fone?x=1&tag=a&tag=b+c&flag&q=%26%3D HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, r.URL.Form)
+	assert.Equal(t, "/video/my clip/one", r.URL.Path)
+	assert.Equal(t, "/video/my%20clip%2Fone", r.URL.RawPath)
+	assert.Equal(t, "x=1&tag=a&tag=b+c&flag&q=%26%3D", r.URL.RawQuery)
+	assert.Equal(t, "1", r.URL.Query.Get("x"))
+	assert.Equal(t, []string{"a", "b c"}, r.URL.Query["tag"])
+	assert.True(t, r.URL.Query.Has("flag"))
+	assert.Equal(t, "&=", r.URL.Query.Get("q"))
+	assert.False(t, r.URL.Query.Has("missing"))
+
+	assert.Equal(t, []string{"video", "my clip/one"}, r.URL.Segments())
+
+	// Test: a plus in the path is not a space
+	r, err = parse("GET /a+b HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "/a+b", r.URL.Path)
+
+	// Test: absolute form
+	r, err = parse("GET HTTP://example.com:8080?x=1 HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, r.URL.Form)
+	assert.Equal(t, "http", r.URL.Scheme)
+	assert.Equal(t, "example.com:8080", r.URL.Host)
+	assert.Equal(t, "/", r.URL.Path)
+	assert.Equal(t, "1", r.URL.Query.Get("x"))
+
+	// Test: authority form for CONNECT
+	r, err = parse("CONNECT example.com:443 HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.URL.Form)
+	assert.Equal(t, "example.com:443", r.URL.Host)
+	r, err = parse("CONNECT [::1]:443 HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:443", r.URL.Host)
+
+	// Test: asterisk form for OPTIONS
+	r, err = parse("OPTIONS * HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, r.URL.Form)
+
+	invalid := map[string]error{
+		"GET /a%2 HTTP/1.1":                  ErrInvalidPercentEncoding,
+		"GET /a%zz HTTP/1.1":                 ErrInvalidPercentEncoding,
+		"GET /a?q=%G1 HTTP/1.1":              ErrInvalidPercentEncoding,
+		"GET /page#section HTTP/1.1":         ErrInvalidTarget,
+		"GET * HTTP/1.1":                     ErrInvalidTarget,
+		"GET example.com:443 HTTP/1.1":       ErrInvalidTarget,
+		"GET relative/path HTTP/1.1":         ErrInvalidTarget,
+		"GET http://user@evil/ HTTP/1.1":     ErrInvalidTarget,
+		"CONNECT /path HTTP/1.1":             ErrInvalidTarget,
+		"CONNECT example.com HTTP/1.1":       ErrInvalidTarget,
+		"GET /caf\xc3\xa9 HTTP/1.1":          ErrInvalidTarget,
+		"CONNECT example.com:https HTTP/1.1": ErrInvalidTarget,
+	}
+	for requestLine, expected := range invalid {
+		_, err := parse(requestLine)
+		require.ErrorIs(t, err, expected, requestLine)
+		assert.Equal(t, 400, StatusCode(err), requestLine)
+		var parseErr *ParseError
+		require.ErrorAs(t, err, &parseErr)
+		assert.Equal(t, int64(strings.Index(requestLine, " ")+1), parseErr.Offset, requestLine)
+	}
+}
+
+type testKey struct{}
+
+func TestRequestContext(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET /a HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, context.Background(), r.Context())
+
+	ctx := context.WithValue(context.Background(), testKey{}, "value")
+	derived := r.WithContext(ctx)
+	assert.Equal(t, "value", derived.Context().Value(testKey{}))
+	assert.Equal(t, "/a", derived.URL.Path)
+	// Test: the original request keeps its context
+	assert.Nil(t, r.Context().Value(testKey{}))
+	assert.Panics(t, func() { r.WithContext(nil) })
+}
@@ -0,0 +1,232 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidTarget          = errors.New("request: invalid request target")
+	ErrInvalidPercentEncoding = errors.New("request: invalid percent-encoding")
+)
+
+// TargetForm is one of the four request-target forms of RFC 9112 section 3.2.
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path with an optional query: /where?q=now.
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a complete URI, as sent to proxies:
+	// http://www.example.org/pub/WWW/TheProject.html.
+	AbsoluteForm
+	// AuthorityForm is host and port only, used by CONNECT: example.com:443.
+	AuthorityForm
+	// AsteriskForm is a lone "*", used by a server-wide OPTIONS request.
+	AsteriskForm
+)
+
+// URL is the parsed request target.
+type URL struct {
+	Form TargetForm
+	// Scheme is set for the absolute form only.
+	Scheme string
+	// Host is set for the absolute and authority forms.
+	Host string
+	// Path is the percent-decoded path. It is empty for the authority and
+	// asterisk forms.
+	Path string
+	// RawPath is the path as sent, still percent-encoded.
+	RawPath string
+	// RawQuery is the query without the leading '?', still percent-encoded.
+	RawQuery string
+	Query    Query
+}
+
+// Query holds the decoded query parameters. A key repeated in the query has
+// its values kept in order.
+type Query map[string][]string
+
+// Get returns the first value of key, or "" when it is missing.
+func (q Query) Get(key string) string {
+	if values := q[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Has reports whether key appears in the query, with or without a value.
+func (q Query) Has(key string) bool {
+	_, ok := q[key]
+	return ok
+}
+
+// Segments splits the path at its slashes and decodes each segment on its
+// own, so that an encoded slash stays part of its segment: /a%2Fb/c gives
+// "a/b" and "c". The root path has a single empty segment, and paths of the
+// authority and asterisk forms have none.
+func (u *URL) Segments() []string {
+	if !strings.HasPrefix(u.RawPath, "/") {
+		return nil
+	}
+	segments := strings.Split(u.RawPath[1:], "/")
+	for i, segment := range segments {
+		// The path was validated when the target was parsed.
+		segments[i], _ = unescape(segment, false)
+	}
+	return segments
+}
+
+// parseRequestTarget parses the target of a request line according to the
+// form the method calls for.
+func parseRequestTarget(method string, target string) (*URL, error) {
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] >= 0x7F {
+			return nil, newParseError(ErrInvalidTarget, fmt.Sprintf("byte %#x in target", target[i]))
+		}
+	}
+	if strings.Contains(target, "#") {
+		return nil, newParseError(ErrInvalidTarget, "target contains a fragment")
+	}
+	switch {
+	case method == "CONNECT":
+		return parseAuthorityForm(target)
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, newParseError(ErrInvalidTarget, fmt.Sprintf("asterisk form is only allowed for OPTIONS, not %v", method))
+		}
+		return &URL{Form: AsteriskForm, Query: Query{}}, nil
+	case strings.HasPrefix(target, "/"):
+		u := &URL{Form: OriginForm}
+		return u, u.setPathAndQuery(target)
+	}
+	return parseAbsoluteForm(target)
+}
+
+func parseAuthorityForm(target string) (*URL, error) {
+	host, port, found := strings.Cut(target, ":")
+	if strings.HasPrefix(target, "[") {
+		// An IPv6 literal, whose colons belong to the address.
+		end := strings.Index(target, "]")
+		if end == -1 {
+			return nil, newParseError(ErrInvalidTarget, "unterminated IPv6 address")
+		}
+		host = target[:end+1]
+		port, found = strings.CutPrefix(target[end+1:], ":")
+	}
+	if !found || host == "" || port == "" || strings.Trim(port, "0123456789") != "" || strings.ContainsAny(host, "/?@") {
+		return nil, newParseError(ErrInvalidTarget, fmt.Sprintf("%q is not host:port", target))
+	}
+	return &URL{Form: AuthorityForm, Host: target, Query: Query{}}, nil
+}
+
+func parseAbsoluteForm(target string) (*URL, error) {
+	scheme, rest, found := strings.Cut(target, "://")
+	if !found || !isScheme(scheme) {
+		return nil, newParseError(ErrInvalidTarget, fmt.Sprintf("%q is neither a path nor an absolute URI", target))
+	}
+	authorityEnd := strings.IndexAny(rest, "/?")
+	if authorityEnd == -1 {
+		authorityEnd = len(rest)
+	}
+	u := &URL{Form: AbsoluteForm, Scheme: strings.ToLower(scheme), Host: rest[:authorityEnd]}
+	if u.Host == "" || strings.Contains(u.Host, "@") {
+		// Userinfo is deprecated in http URIs and only good for phishing.
+		return nil, newParseError(ErrInvalidTarget, "absolute URI needs a host without userinfo")
+	}
+	pathAndQuery := rest[authorityEnd:]
+	if !strings.HasPrefix(pathAndQuery, "/") {
+		pathAndQuery = "/" + pathAndQuery
+	}
+	return u, u.setPathAndQuery(pathAndQuery)
+}
+
+// isScheme reports whether s matches ALPHA *( ALPHA / DIGIT / "+" / "-" / "." ).
+func isScheme(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !isAlpha(c) && !('0' <= c && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func (u *URL) setPathAndQuery(target string) error {
+	u.RawPath, u.RawQuery, _ = strings.Cut(target, "?")
+	path, err := unescape(u.RawPath, false)
+	if err != nil {
+		return err
+	}
+	u.Path = path
+	u.Query, err = parseQuery(u.RawQuery)
+	return err
+}
+
+// parseQuery decodes an application/x-www-form-urlencoded query, where '+'
+// stands for a space.
+func parseQuery(rawQuery string) (Query, error) {
+	query := Query{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			return nil, err
+		}
+		value, err := unescape(rawValue, true)
+		if err != nil {
+			return nil, err
+		}
+		query[key] = append(query[key], value)
+	}
+	return query, nil
+}
+
+// unescape decodes %XX sequences, and '+' into a space when plusIsSpace is
+// set. A '%' not followed by two hex digits is an error.
+func unescape(s string, plusIsSpace bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+	var decoded strings.Builder
+	decoded.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", newParseError(ErrInvalidPercentEncoding, fmt.Sprintf("%q", s[i:min(i+3, len(s))]))
+			}
+			decoded.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case s[i] == '+' && plusIsSpace:
+			decoded.WriteByte(' ')
+		default:
+			decoded.WriteByte(s[i])
+		}
+	}
+	return decoded.String(), nil
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,167 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"httpFromTCP/internal/headers"
+	"strings"
+	"time"
+)
+
+// StrongETag returns an entity tag that changes whenever content does, for
+// representations that are cheap to hash.
+func StrongETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// WeakETag returns an entity tag for a file derived from its modification
+// time and size. Two versions written within the clock resolution with the
+// same size share it, which is why it is only weak.
+func WeakETag(modTime time.Time, size int64) string {
+	return fmt.Sprintf(`W/"%x-%x"`, modTime.UnixNano(), size)
+}
+
+// entityTag is a parsed entity tag, opaque being the quoted part.
+type entityTag struct {
+	weak   bool
+	opaque string
+}
+
+func parseETag(value string) (entityTag, bool) {
+	tag, rest, ok := scanETag(strings.TrimSpace(value))
+	return tag, ok && rest == ""
+}
+
+// scanETag parses the entity tag at the start of s and returns the rest.
+func scanETag(s string) (entityTag, string, bool) {
+	var tag entityTag
+	if strings.HasPrefix(s, "W/") {
+		tag.weak = true
+		s = s[2:]
+	}
+	if !strings.HasPrefix(s, `"`) {
+		return entityTag{}, "", false
+	}
+	end := strings.IndexByte(s[1:], '"')
+	if end == -1 {
+		return entityTag{}, "", false
+	}
+	tag.opaque = s[:end+2]
+	for i := 1; i < len(tag.opaque)-1; i++ {
+		if c := tag.opaque[i]; c < 0x21 || c == 0x7F {
+			return entityTag{}, "", false
+		}
+	}
+	return tag, s[end+2:], true
+}
+
+// matchETags reports whether the If-Match or If-None-Match list in value
+// matches etag, comparing strongly or weakly. The list "*" matches any
+// current representation. An etag of "" stands for a representation without
+// one. A malformed list matches nothing.
+func matchETags(value string, etag string, strong bool) bool {
+	value = strings.TrimSpace(value)
+	if value == "*" {
+		return true
+	}
+	current, ok := parseETag(etag)
+	if !ok {
+		return false
+	}
+	for value != "" {
+		tag, rest, ok := scanETag(value)
+		if !ok {
+			return false
+		}
+		if tag.opaque == current.opaque && (!strong || (!tag.weak && !current.weak)) {
+			return true
+		}
+		value = strings.TrimLeft(rest, " \t")
+		if value != "" {
+			if value[0] != ',' {
+				return false
+			}
+			value = strings.TrimLeft(value[1:], " \t,")
+		}
+	}
+	return false
+}
+
+// EvaluatePreconditions evaluates the conditional header fields of a request
+// against the validators of the selected representation, in the order of RFC
+// 9110 section 13.2.2. It returns 304 Not Modified or 412 Precondition
+// Failed when the request should be answered with that instead, and 0 when
+// it may proceed. lastModified may be zero and etag empty when the
+// representation has no such validator.
+func EvaluatePreconditions(method string, h *headers.Headers, etag string, lastModified time.Time) StatusCode {
+	lastModified = lastModified.Truncate(time.Second)
+	if ifMatch, ok := h.Get(headers.IF_MATCH); ok {
+		if !matchETags(ifMatch, etag, true) {
+			return STATUS_CODE_PRECONDITION_FAILED
+		}
+	} else if value, ok := h.Get(headers.IF_UNMODIFIED_SINCE); ok && !lastModified.IsZero() {
+		if date, err := ParseHTTPDate(value); err == nil && lastModified.After(date) {
+			return STATUS_CODE_PRECONDITION_FAILED
+		}
+	}
+	safe := method == "GET" || method == "HEAD"
+	if ifNoneMatch, ok := h.Get(headers.IF_NONE_MATCH); ok {
+		if !matchETags(ifNoneMatch, etag, false) {
+			return 0
+		}
+		if safe {
+			return STATUS_CODE_NOT_MODIFIED
+		}
+		return STATUS_CODE_PRECONDITION_FAILED
+	}
+	if value, ok := h.Get(headers.IF_MODIFIED_SINCE); ok && safe && !lastModified.IsZero() {
+		if date, err := ParseHTTPDate(value); err == nil && !lastModified.After(date) {
+			return STATUS_CODE_NOT_MODIFIED
+		}
+	}
+	return 0
+}
+
+// IfRangeMatches reports whether the If-Range value names the current
+// representation, so that the ranges requested along with it can be sent.
+// An entity tag has to match strongly, a date has to equal lastModified.
+func IfRangeMatches(value string, etag string, lastModified time.Time) bool {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		tag, ok := parseETag(value)
+		return ok && !tag.weak && matchETags(value, etag, true)
+	}
+	date, err := ParseHTTPDate(value)
+	return err == nil && !lastModified.IsZero() && date.Equal(lastModified.Truncate(time.Second))
+}
+
+// CheckPreconditions sets the ETag and Last-Modified of the response, leaving
+// out empty ones, and evaluates the conditional fields h of the request
+// against them. When a precondition fails it writes the 304 or 412 and
+// reports true, the handler is done then. A Last-Modified in the future is
+// sent as the current time.
+func (w *Writer) CheckPreconditions(method string, h *headers.Headers, etag string, lastModified time.Time) (bool, error) {
+	if now := time.Now(); lastModified.After(now) {
+		lastModified = now
+	}
+	if etag != "" {
+		w.Header().Set(headers.ETAG, etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set(headers.LAST_MODIFIED, FormatHTTPDate(lastModified))
+	}
+	switch status := EvaluatePreconditions(method, h, etag, lastModified); status {
+	case STATUS_CODE_NOT_MODIFIED:
+		return true, w.WriteHeader(status)
+	case STATUS_CODE_PRECONDITION_FAILED:
+		w.Header().Set(headers.CONTENT_TYPE, "text/plain")
+		if err := w.WriteHeader(status); err != nil {
+			return true, err
+		}
+		_, err := w.Write([]byte(StatusText(status)))
+		return true, err
+	}
+	return false, nil
+}
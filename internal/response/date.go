@@ -0,0 +1,35 @@
+package response
+
+import (
+	"fmt"
+	"time"
+)
+
+// HTTP_DATE_FORMAT is the IMF-fixdate format of RFC 9110 section 5.6.7, the
+// one dates are sent in.
+const HTTP_DATE_FORMAT = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// obsoleteDateFormats are the RFC 850 and asctime formats recipients still
+// have to accept.
+var obsoleteDateFormats = []string{
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// FormatHTTPDate formats t as an IMF-fixdate.
+func FormatHTTPDate(t time.Time) string {
+	return t.UTC().Format(HTTP_DATE_FORMAT)
+}
+
+// ParseHTTPDate parses a date in any of the three formats of RFC 9110.
+func ParseHTTPDate(value string) (time.Time, error) {
+	if t, err := time.Parse(HTTP_DATE_FORMAT, value); err == nil {
+		return t, nil
+	}
+	for _, format := range obsoleteDateFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("response: invalid HTTP date %q", value)
+}
@@ -0,0 +1,217 @@
+package response
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"httpFromTCP/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MAX_RANGES is the most ranges a single request may ask for.
+const MAX_RANGES = 100
+
+var (
+	// ErrInvalidRange is returned for a Range the server ignores, answering
+	// with the whole representation instead: one that is malformed, has a
+	// unit other than bytes, or asks for more ranges or bytes than there are.
+	ErrInvalidRange = errors.New("response: invalid range")
+	// ErrRangeNotSatisfiable is returned when none of the ranges overlaps
+	// the representation, which is answered with a 416.
+	ErrRangeNotSatisfiable = errors.New("response: range not satisfiable")
+)
+
+// ByteRange is a range of Length bytes starting at Start.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// contentRange returns the Content-Range value of the range within a
+// representation of size bytes.
+func (r ByteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses the value of a Range header for a representation of size
+// bytes, as defined by RFC 9110 section 14.1.2. Ranges reaching past the end
+// are shortened and ranges starting past it are dropped.
+func ParseRange(value string, size int64) ([]ByteRange, error) {
+	unit, set, found := strings.Cut(value, "=")
+	if !found || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRange, value)
+	}
+	var ranges []ByteRange
+	specs, unsatisfiable := 0, 0
+	var total int64
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specs++
+		if specs > MAX_RANGES {
+			return nil, fmt.Errorf("%w: more than %d ranges", ErrInvalidRange, MAX_RANGES)
+		}
+		r, ok, err := parseRangeSpec(spec, size)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidRange, spec)
+		}
+		if !ok {
+			unsatisfiable++
+			continue
+		}
+		ranges = append(ranges, r)
+		total += r.Length
+	}
+	switch {
+	case specs == 0:
+		return nil, fmt.Errorf("%w: no ranges in %q", ErrInvalidRange, value)
+	case unsatisfiable == specs:
+		return nil, ErrRangeNotSatisfiable
+	case total > size:
+		// Overlapping ranges would make the response larger than the
+		// representation itself.
+		return nil, fmt.Errorf("%w: ranges overlap", ErrInvalidRange)
+	}
+	return ranges, nil
+}
+
+// parseRangeSpec parses a single first-last, first- or -suffix range. It
+// reports false for a well-formed range that lies outside of the
+// representation.
+func parseRangeSpec(spec string, size int64) (ByteRange, bool, error) {
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return ByteRange{}, false, ErrInvalidRange
+	}
+	if first == "" {
+		suffix, err := parseRangeNumber(last)
+		if err != nil {
+			return ByteRange{}, false, err
+		}
+		if suffix == 0 || size == 0 {
+			return ByteRange{}, false, nil
+		}
+		suffix = min(suffix, size)
+		return ByteRange{Start: size - suffix, Length: suffix}, true, nil
+	}
+	start, err := parseRangeNumber(first)
+	if err != nil {
+		return ByteRange{}, false, err
+	}
+	end := size - 1
+	if last != "" {
+		end, err = parseRangeNumber(last)
+		if err != nil {
+			return ByteRange{}, false, err
+		}
+		if end < start {
+			return ByteRange{}, false, ErrInvalidRange
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return ByteRange{}, false, nil
+	}
+	return ByteRange{Start: start, Length: end - start + 1}, true, nil
+}
+
+func parseRangeNumber(s string) (int64, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, ErrInvalidRange
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// WriteRanges answers with a 206 carrying the given ranges of content, a
+// representation of size bytes with the given media type. A single range is
+// sent as is with its Content-Range, several ranges as a
+// multipart/byteranges body.
+func (w *Writer) WriteRanges(content io.ReadSeeker, size int64, contentType string, ranges []ByteRange) error {
+	if len(ranges) == 0 {
+		return fmt.Errorf("%w: no ranges", ErrInvalidRange)
+	}
+	h := w.Header()
+	if len(ranges) == 1 {
+		h.Set(headers.CONTENT_RANGE, ranges[0].contentRange(size))
+		h.Set(headers.CONTENT_TYPE, contentType)
+		h.Set(headers.CONTENT_LENGTH, strconv.FormatInt(ranges[0].Length, 10))
+		if err := w.WriteHeader(STATUS_CODE_PARTIAL_CONTENT); err != nil {
+			return err
+		}
+		return w.copyRange(content, ranges[0])
+	}
+
+	boundary, err := newBoundary()
+	if err != nil {
+		return err
+	}
+	// Every part is preceded by its own header, so the length of the body
+	// is known before any of it is read.
+	partHeaders := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		partHeaders[i] = fmt.Sprintf("--%v\r\nContent-Type: %v\r\nContent-Range: %v\r\n\r\n", boundary, contentType, r.contentRange(size))
+		if i > 0 {
+			partHeaders[i] = "\r\n" + partHeaders[i]
+		}
+		length += int64(len(partHeaders[i])) + r.Length
+	}
+	closing := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(closing))
+	h.Del(headers.CONTENT_RANGE)
+	h.Set(headers.CONTENT_TYPE, "multipart/byteranges; boundary="+boundary)
+	h.Set(headers.CONTENT_LENGTH, strconv.FormatInt(length, 10))
+	if err := w.WriteHeader(STATUS_CODE_PARTIAL_CONTENT); err != nil {
+		return err
+	}
+	for i, r := range ranges {
+		if _, err := w.Write([]byte(partHeaders[i])); err != nil {
+			return err
+		}
+		if err := w.copyRange(content, r); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write([]byte(closing))
+	return err
+}
+
+// copyRange writes one range of content, which is not even read for a HEAD
+// response.
+func (w *Writer) copyRange(content io.ReadSeeker, r ByteRange) error {
+	if w.omitBody {
+		return nil
+	}
+	if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, content, r.Length)
+	return err
+}
+
+// WriteRangeNotSatisfiable answers with a 416 telling the client the size of
+// the representation, size bytes, its ranges have to fall within.
+func (w *Writer) WriteRangeNotSatisfiable(size int64) error {
+	h := w.Header()
+	h.Set(headers.CONTENT_RANGE, fmt.Sprintf("bytes */%d", size))
+	h.Set(headers.CONTENT_TYPE, "text/plain")
+	h.Del(headers.CONTENT_LENGTH)
+	if err := w.WriteHeader(STATUS_CODE_RANGE_NOT_SATISFIABLE); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(StatusText(STATUS_CODE_RANGE_NOT_SATISFIABLE)))
+	return err
+}
+
+func newBoundary() (string, error) {
+	var boundary [16]byte
+	if _, err := rand.Read(boundary[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(boundary[:]), nil
+}
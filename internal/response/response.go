@@ -1,126 +1,591 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"httpFromTCP/internal/constants"
 	"httpFromTCP/internal/headers"
 	"io"
+	"strconv"
+	"strings"
 )
 
-type StatusCode int
+type WriterState = string
 
 const (
-	STATUS_CODE_OK                    StatusCode = 200
-	STATUS_CODE_BAD_REQUEST           StatusCode = 400
-	STATUS_CODE_INTERNAL_SERVER_ERROR StatusCode = 500
+	// StateInitialized: nothing has been written yet.
+	StateInitialized WriterState = "INITIALIZED"
+	// StateStatusLine: the status is recorded but not sent.
+	StateStatusLine WriterState = "STATUS_LINE"
+	// StateHeaders: the headers are recorded but not sent, body bytes may be
+	// buffered while the writer waits to learn the body length.
+	StateHeaders WriterState = "STATE_HEADERS"
+	// StateBody: the head was sent and the body is written as is.
+	StateBody WriterState = "STATE_BODY"
+	// StateChunkedBody: the head was sent and the body is written in chunks.
+	StateChunkedBody WriterState = "STATE_CHUNKED_BODY"
+	// StateChunkedBodyDone: the last chunk was sent, trailers may follow.
+	StateChunkedBodyDone WriterState = "STATE_CHUNKED_BODY_DONE"
+	StateDone            WriterState = "STATE_DONE"
+	// StateError: writing to the connection failed, the response is broken.
+	StateError WriterState = "STATE_ERROR"
 )
 
-type WriterState = string
+const DEFAULT_HTTP_VERSION = "1.1"
+
+// BODY_BUFFER_SIZE is how much of a body without a declared length is held
+// back so that Content-Length can still be filled in. Bodies that outgrow it
+// are sent chunked.
+const BODY_BUFFER_SIZE = 4096
+
+var (
+	ErrHeadersAlreadySent    = errors.New("response: headers were already sent")
+	ErrContentLengthExceeded = errors.New("response: body is longer than the declared content-length")
+	ErrBodyTooShort          = errors.New("response: body is shorter than the declared content-length")
+	ErrBodyNotAllowed        = errors.New("response: status does not allow a body")
+	ErrInvalidContentLength  = errors.New("response: invalid content-length")
+	ErrResponseDone          = errors.New("response: writing after the response was finished")
+	ErrWriteFailed           = errors.New("response: an earlier write to the connection failed")
+	ErrInterimStatus         = errors.New("response: 1xx statuses are interim and can't be the final status")
+)
+
+type bodyFraming int
 
 const (
-	StateInitialized     WriterState = "INITIALIZED"
-	StateStatusLine      WriterState = "STATUS_LINE"
-	StateHeaders         WriterState = "STATE_HEADERS"
-	StateBody            WriterState = "STATE_BODY"
-	StateChunkedBody     WriterState = "STATE_CHUNKED_BODY"
-	StateChunkedBodyDone WriterState = "STATE_CHUNKED_BODY_DONE"
-	StateError           WriterState = "STATE_ERROR"
+	// framingUndecided: no length or transfer coding was declared, the body
+	// is buffered until the writer knows how long it is.
+	framingUndecided bodyFraming = iota
+	framingLength
+	framingChunked
+	// framingClose delimits the body by closing the connection, which is the
+	// only option left for HTTP/1.0 when the length is unknown.
+	framingClose
+	// framingNone is used for statuses that never carry a body.
+	framingNone
 )
 
 type Writer struct {
 	w           io.Writer
 	writerState WriterState
+	keepAlive   bool
+	version     string
+	// omitBody is set for responses to HEAD requests.
+	omitBody bool
+	// beforeHeaders is called right before the headers are sent.
+	beforeHeaders func()
+
+	statusCode    StatusCode
+	reason        string
+	header        *headers.Headers
+	headersSent   bool
+	framing       bodyFraming
+	contentLength int64
+	buffer        []byte
+	// written counts the body bytes sent so far, without chunk framing.
+	written int64
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{w, StateInitialized}
+	return &Writer{w: w, writerState: StateInitialized, version: DEFAULT_HTTP_VERSION}
 }
-func (w *Writer) Write(data []byte) (int, error) {
-	return w.w.Write(data)
+
+// SetVersion sets the HTTP version written in the status line, which should
+// be the version of the request being answered. Only "1.0" and "1.1" are
+// accepted.
+func (w *Writer) SetVersion(version string) error {
+	if version != "1.0" && version != "1.1" {
+		return fmt.Errorf("response: unsupported HTTP version %q", version)
+	}
+	w.version = version
+	return nil
+}
+
+// SetKeepAlive tells the writer whether the connection may be reused after
+// this response. It has to be called before the headers are sent.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// SetOmitBody makes the writer send only the head of the response, as the
+// answer to a HEAD request. Body bytes are counted, so that Content-Length
+// can still be filled in from them, but never sent. A declared Content-Length
+// does not have to be matched by the body.
+func (w *Writer) SetOmitBody(omit bool) {
+	w.omitBody = omit
+}
+
+// SetBeforeHeaders registers hook to be called right before the headers are
+// sent, when it may still call SetKeepAlive.
+func (w *Writer) SetBeforeHeaders(hook func()) {
+	w.beforeHeaders = hook
+}
+
+// KeepAlive reports whether the response was completed and framed so that
+// another response can follow on the same connection.
+func (w *Writer) KeepAlive() bool {
+	return w.writerState == StateDone && w.keepAlive
+}
+
+// HeadersSent reports whether the status line and headers reached the
+// connection, after which the response can no longer be replaced.
+func (w *Writer) HeadersSent() bool {
+	return w.headersSent
 }
+
+// Status returns the status of the response, or 0 while none was written.
+func (w *Writer) Status() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns how many body bytes were written so far, whether they
+// were already sent or are still buffered.
+func (w *Writer) BytesWritten() int64 {
+	return w.written + int64(len(w.buffer))
+}
+
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineWithReason(statusCode, "")
+}
+
+// WriteStatusLineWithReason records the status with a custom reason phrase.
+// An empty reason falls back to the standard one. The status line is sent
+// together with the headers. 1xx statuses are refused since the writer only
+// sends final responses.
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reason string) error {
 	if w.writerState != StateInitialized {
 		return fmt.Errorf("response: writing status line while not initialized")
 	}
-	statusLine := getStatusLine(statusCode)
-	_, err := w.Write([]byte(statusLine + constants.SEPARATOR))
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("response: invalid status code %d", statusCode)
+	}
+	if statusCode < 200 {
+		return fmt.Errorf("%w: %d", ErrInterimStatus, statusCode)
+	}
+	if i := strings.IndexFunc(reason, isForbiddenReasonRune); i != -1 {
+		return fmt.Errorf("response: control character %q in reason phrase", reason[i])
+	}
+	w.statusCode = statusCode
+	w.reason = reason
 	w.writerState = StateStatusLine
-	return err
+	return nil
+}
+
+// Header returns the headers that will be sent with the response. The map
+// can be changed until the headers are sent, later changes have no effect.
+func (w *Writer) Header() *headers.Headers {
+	if w.header == nil {
+		w.header = headers.NewHeaders()
+	}
+	return w.header
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+// WriteHeader records the status and the headers set through Header. The
+// head is sent with the first body bytes that can't be buffered, on Flush or
+// on Finish, so that a missing Content-Length can still be filled in.
+func (w *Writer) WriteHeader(statusCode StatusCode) error {
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	return w.WriteHeaders(w.Header())
+}
+
+// WriteHeaders records the status with the headers set through Header, where
+// the fields of h replace those of the same name.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
 	if w.writerState != StateStatusLine {
 		return fmt.Errorf("response: writing headers without writing status line")
 	}
-	_, err := w.Write([]byte(headers.GetAsString()))
-	v, ok := headers.Get("transfer-encoding")
-	if !ok || v != "chunked" {
-		w.writerState = StateHeaders
+	if err := h.Validate(); err != nil {
+		return err
 	}
-	w.writerState = StateChunkedBody
-	return err
+	header := w.Header()
+	if h != header {
+		for name := range h.All() {
+			header.Del(name)
+		}
+		for name, value := range h.All() {
+			header.Add(name, value)
+		}
+	}
+	if _, _, err := declaredFraming(w.statusCode, header); err != nil {
+		return err
+	}
+	w.writerState = StateHeaders
+	return nil
 }
 
-func (w *Writer) WriteBody(data []byte) error {
-	if w.writerState != StateHeaders {
-		return fmt.Errorf("response: writing body without writing headers")
+// declaredFraming works out how the body is delimited from the status and
+// the headers set by the handler.
+func declaredFraming(statusCode StatusCode, h *headers.Headers) (bodyFraming, int64, error) {
+	if !BodyAllowed(statusCode) {
+		return framingNone, 0, nil
+	}
+	if transferEncoding, ok := h.Get(headers.TRANSFER_ENCODING); ok {
+		if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+			return 0, 0, fmt.Errorf("response: unsupported transfer-encoding %q", transferEncoding)
+		}
+		return framingChunked, 0, nil
 	}
+	if value, ok := h.Get(headers.CONTENT_LENGTH); ok {
+		contentLength, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || contentLength < 0 {
+			return 0, 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+		}
+		return framingLength, contentLength, nil
+	}
+	return framingUndecided, 0, nil
+}
+
+// BodyAllowed reports whether a response with this status may have a body.
+func BodyAllowed(statusCode StatusCode) bool {
+	return statusCode >= 200 && statusCode != STATUS_CODE_NO_CONTENT && statusCode != STATUS_CODE_NOT_MODIFIED
+}
+
+// Write writes body bytes. It can be called any number of times. Without a
+// prior WriteHeader the first call sends a 200 with the headers set through
+// Header.
+func (w *Writer) Write(data []byte) (int, error) {
+	switch w.writerState {
+	case StateInitialized:
+		if err := w.WriteHeader(STATUS_CODE_OK); err != nil {
+			return 0, err
+		}
+	case StateStatusLine:
+		if err := w.WriteHeaders(w.Header()); err != nil {
+			return 0, err
+		}
+	}
+	switch w.writerState {
+	case StateHeaders:
+		framing, _, err := declaredFraming(w.statusCode, w.header)
+		if err != nil {
+			return 0, err
+		}
+		if framing == framingNone && len(data) > 0 {
+			return 0, fmt.Errorf("%w: %d", ErrBodyNotAllowed, w.statusCode)
+		}
+		if framing == framingUndecided && len(w.buffer)+len(data) <= BODY_BUFFER_SIZE {
+			w.buffer = append(w.buffer, data...)
+			return len(data), nil
+		}
+		if err := w.sendHeaders(false, data); err != nil {
+			return 0, err
+		}
+	case StateBody, StateChunkedBody:
+	case StateError:
+		return 0, ErrWriteFailed
+	default:
+		return 0, ErrResponseDone
+	}
+	return w.writeBody(data)
+}
+
+func (w *Writer) WriteBody(data []byte) error {
 	_, err := w.Write(data)
-	w.writerState = StateBody
 	return err
 }
 
+// Flush sends the status line, the headers and any buffered body bytes right
+// away. A body without a declared length is then sent chunked, or delimited
+// by closing the connection for HTTP/1.0 clients.
+func (w *Writer) Flush() error {
+	if w.writerState != StateHeaders {
+		return nil
+	}
+	return w.sendHeaders(false, nil)
+}
+
+// Finish completes the response: it sends whatever is still pending, with a
+// Content-Length when the whole body was buffered, and terminates a chunked
+// body. A handler that wrote nothing gets an empty 200. It fails when fewer
+// bytes than the declared Content-Length were written, in which case the
+// connection can't be reused.
+func (w *Writer) Finish() error {
+	if w.writerState == StateInitialized {
+		if err := w.WriteHeader(STATUS_CODE_OK); err != nil {
+			return err
+		}
+	}
+	if w.writerState == StateStatusLine {
+		if err := w.WriteHeaders(w.Header()); err != nil {
+			return err
+		}
+	}
+	if w.writerState == StateHeaders {
+		if err := w.sendHeaders(true, nil); err != nil {
+			return err
+		}
+	}
+	switch w.writerState {
+	case StateDone:
+		return nil
+	case StateError:
+		return ErrWriteFailed
+	case StateChunkedBody:
+		if _, err := w.writeFraming([]byte("0" + constants.SEPARATOR + constants.SEPARATOR)); err != nil {
+			return err
+		}
+	case StateChunkedBodyDone:
+		if _, err := w.writeFraming([]byte(constants.SEPARATOR)); err != nil {
+			return err
+		}
+	case StateBody:
+		if w.framing == framingLength && w.written < w.contentLength && !w.omitBody {
+			w.writerState = StateError
+			return fmt.Errorf("%w: wrote %d of %d bytes", ErrBodyTooShort, w.written, w.contentLength)
+		}
+	}
+	w.writerState = StateDone
+	return nil
+}
+
+// Reset drops the status, headers and body recorded so far so that another
+// response can be written instead. It fails once the headers were sent.
+func (w *Writer) Reset() error {
+	if w.headersSent {
+		return ErrHeadersAlreadySent
+	}
+	w.writerState = StateInitialized
+	w.statusCode = 0
+	w.reason = ""
+	w.header = nil
+	w.framing = framingUndecided
+	w.contentLength = 0
+	w.buffer = nil
+	w.written = 0
+	return nil
+}
+
+// WriteChunkedBody writes p as a single chunk. The headers must have declared
+// Transfer-Encoding: chunked.
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if err := w.sendChunkedHeaders(p); err != nil {
+		return 0, err
+	}
 	if w.writerState != StateChunkedBody {
 		return 0, fmt.Errorf("response: writing chunked body while in wrong state")
 	}
-	count := len(p)
-	lengthLine := fmt.Sprintf("%x%s", count, constants.SEPARATOR)
-	_, err := w.Write([]byte(lengthLine))
-	if err != nil {
-		return 0, err
-	}
-	dataLine := append(p, []byte(constants.SEPARATOR)...)
-	n, err := w.Write(dataLine)
-	return n, err
+	return w.writeBody(p)
 }
 
+// WriteChunkedBodyDone writes the last chunk. Trailers and the final
+// separator may follow, otherwise Finish ends the response.
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if err := w.sendChunkedHeaders(nil); err != nil {
+		return 0, err
+	}
 	if w.writerState != StateChunkedBody {
 		return 0, fmt.Errorf("response: writing chunked body done while in wrong state")
 	}
-	closingString := fmt.Sprintf("0%s", constants.SEPARATOR)
-	n, err := w.Write([]byte(closingString))
+	n, err := w.writeFraming([]byte("0" + constants.SEPARATOR))
 	if err != nil {
-		w.writerState = StateError
 		return 0, err
 	}
 	w.writerState = StateChunkedBodyDone
-	return n, err
+	return n, nil
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
-
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
 	if w.writerState != StateChunkedBodyDone {
 		return fmt.Errorf("response: cannot write trailers without writing chunked body")
 	}
-	_, err := w.Write([]byte(h.GetAsStringWithoutFinalTermination()))
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	_, err := w.writeFraming([]byte(h.GetAsStringWithoutFinalTermination()))
 	return err
 }
 
+// WriteSeparator ends the trailer section, completing a chunked response.
 func (w *Writer) WriteSeparator() error {
-	_, err := w.Write([]byte(constants.SEPARATOR))
+	if w.writerState != StateChunkedBodyDone {
+		return fmt.Errorf("response: writing separator without writing chunked body done")
+	}
+	if _, err := w.writeFraming([]byte(constants.SEPARATOR)); err != nil {
+		return err
+	}
+	w.writerState = StateDone
+	return nil
+}
+
+// sendChunkedHeaders sends the pending head when the headers declared
+// chunked encoding, so that chunks can be written explicitly. Like Write it
+// implies a 200 when no status was written.
+func (w *Writer) sendChunkedHeaders(next []byte) error {
+	switch w.writerState {
+	case StateInitialized:
+		if err := w.WriteHeader(STATUS_CODE_OK); err != nil {
+			return err
+		}
+	case StateStatusLine:
+		if err := w.WriteHeaders(w.Header()); err != nil {
+			return err
+		}
+	}
+	if w.writerState != StateHeaders {
+		return nil
+	}
+	framing, _, err := declaredFraming(w.statusCode, w.header)
+	if err != nil || framing != framingChunked {
+		return err
+	}
+	return w.sendHeaders(false, next)
+}
+
+// sendHeaders settles the body framing and sends the status line, the headers
+// and the buffered body. complete tells whether the buffer holds the whole
+// body, in which case its length becomes the Content-Length. next are the
+// body bytes about to be written, which are sniffed along with the buffer
+// when no Content-Type was set.
+func (w *Writer) sendHeaders(complete bool, next []byte) error {
+	if w.beforeHeaders != nil {
+		w.beforeHeaders()
+	}
+	h := w.Header()
+	framing, contentLength, err := declaredFraming(w.statusCode, h)
+	if err != nil {
+		return err
+	}
+	w.framing = framing
+	w.contentLength = contentLength
+	if w.framing == framingChunked && w.version == "1.0" {
+		// HTTP/1.0 has no chunked encoding. The chunks are sent as plain
+		// data instead, delimited by closing the connection.
+		h.Del(headers.TRANSFER_ENCODING)
+		h.Del("Trailer")
+		w.framing = framingClose
+	}
+	if w.framing == framingUndecided {
+		switch {
+		case complete && w.omitBody && len(w.buffer) == 0:
+			// A HEAD handler that wrote no body says nothing about its
+			// length.
+			w.framing = framingLength
+		case complete:
+			w.framing = framingLength
+			w.contentLength = int64(len(w.buffer))
+			h.Set(headers.CONTENT_LENGTH, strconv.Itoa(len(w.buffer)))
+		case w.version == "1.1":
+			w.framing = framingChunked
+			h.Set(headers.TRANSFER_ENCODING, "chunked")
+		default:
+			w.framing = framingClose
+		}
+	}
+	if _, ok := h.Get(headers.CONTENT_TYPE); !ok && w.framing != framingNone {
+		sample := w.buffer
+		if len(sample) < SNIFF_LENGTH {
+			rest := next[:min(len(next), SNIFF_LENGTH-len(sample))]
+			sample = append(sample[:len(sample):len(sample)], rest...)
+		}
+		if len(sample) > 0 {
+			h.Set(headers.CONTENT_TYPE, DetectContentType(sample))
+		}
+	}
+	// Header may have been changed after WriteHeaders validated it.
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	connection, _ := h.Get(headers.CONNECTION)
+	if headers.HasToken(connection, "close") || w.framing == framingClose {
+		w.keepAlive = false
+	}
+	if w.keepAlive {
+		h.Set(headers.CONNECTION, "keep-alive")
+	} else {
+		h.Set(headers.CONNECTION, "close")
+	}
+	statusLine := getStatusLine(w.version, w.statusCode, w.reason)
+	if _, err := w.write([]byte(statusLine + constants.SEPARATOR + h.GetAsString())); err != nil {
+		return err
+	}
+	w.headersSent = true
+	if w.framing == framingChunked || framing == framingChunked {
+		w.writerState = StateChunkedBody
+	} else {
+		w.writerState = StateBody
+	}
+	buffered := w.buffer
+	w.buffer = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	_, err = w.writeBody(buffered)
 	return err
 }
 
-func getStatusLine(statusCode StatusCode) string {
-	switch statusCode {
-	case STATUS_CODE_OK:
-		return fmt.Sprintf("HTTP/1.1 %v OK", STATUS_CODE_OK)
-	case STATUS_CODE_BAD_REQUEST:
-		return fmt.Sprintf("HTTP/1.1 %v Bad Request", STATUS_CODE_BAD_REQUEST)
-	case STATUS_CODE_INTERNAL_SERVER_ERROR:
-		return fmt.Sprintf("HTTP/1.1 %v Internal Server Error", STATUS_CODE_INTERNAL_SERVER_ERROR)
+// writeBody frames and sends body bytes once the headers are out.
+func (w *Writer) writeBody(p []byte) (int, error) {
+	switch w.framing {
+	case framingNone:
+		if len(p) > 0 {
+			return 0, fmt.Errorf("%w: %d", ErrBodyNotAllowed, w.statusCode)
+		}
+		return 0, nil
+	case framingLength:
+		if w.written+int64(len(p)) > w.contentLength {
+			return 0, fmt.Errorf("%w: %d bytes declared, %d already written", ErrContentLengthExceeded, w.contentLength, w.written)
+		}
+	case framingChunked:
+		if len(p) == 0 {
+			// An empty chunk would terminate the body.
+			return 0, nil
+		}
+		if w.omitBody {
+			break
+		}
+		chunk := make([]byte, 0, len(p)+20)
+		chunk = fmt.Appendf(chunk, "%x%s", len(p), constants.SEPARATOR)
+		chunk = append(chunk, p...)
+		chunk = append(chunk, constants.SEPARATOR...)
+		if _, err := w.write(chunk); err != nil {
+			return 0, err
+		}
+		w.written += int64(len(p))
+		return len(p), nil
+	}
+	if w.omitBody {
+		w.written += int64(len(p))
+		return len(p), nil
+	}
+	n, err := w.write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// writeFraming sends chunk framing and trailers, which are left out along
+// with the body of a HEAD response and when the chunks are sent to an
+// HTTP/1.0 client as plain data.
+func (w *Writer) writeFraming(p []byte) (int, error) {
+	if w.omitBody || w.framing != framingChunked {
+		return len(p), nil
+	}
+	return w.write(p)
+}
+
+// write sends raw bytes to the connection. A failed write leaves the
+// response half written, so the writer refuses to continue afterwards.
+func (w *Writer) write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.writerState = StateError
+		w.keepAlive = false
+	}
+	return n, err
+}
+
+// isForbiddenReasonRune reports whether r is a control character that may
+// not appear in a reason phrase. Horizontal tab is the only one allowed.
+func isForbiddenReasonRune(r rune) bool {
+	return (r < ' ' && r != '\t') || r == 0x7F
+}
+
+// getStatusLine builds a status line, falling back to the standard reason
+// phrase when reason is empty. Unregistered codes without a custom reason get
+// an empty reason phrase, which the grammar allows.
+func getStatusLine(version string, statusCode StatusCode, reason string) string {
+	if reason == "" {
+		reason = StatusText(statusCode)
 	}
-	return fmt.Sprintf("HTTP/1.1 %v", statusCode)
+	return fmt.Sprintf("HTTP/%v %03d %v", version, statusCode, reason)
 }
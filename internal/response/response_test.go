@@ -0,0 +1,669 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"httpFromTCP/internal/headers"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statusLine finishes the response and returns the status line that was sent.
+func statusLine(t *testing.T, w *Writer, buffer *bytes.Buffer) string {
+	t.Helper()
+	require.NoError(t, w.Finish())
+	line, _, _ := strings.Cut(buffer.String(), "\r\n")
+	return line + "\r\n"
+}
+
+// readResponse parses what the writer sent.
+func readResponse(t *testing.T, buffer *bytes.Buffer) (*http.Response, string) {
+	t.Helper()
+	res, err := http.ReadResponse(bufio.NewReader(buffer), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestStatusText(t *testing.T) {
+	assert.Equal(t, "Not Found", StatusText(STATUS_CODE_NOT_FOUND))
+	assert.Equal(t, "Range Not Satisfiable", StatusText(STATUS_CODE_RANGE_NOT_SATISFIABLE))
+	assert.Equal(t, "", StatusText(299))
+}
+
+func TestWriteStatusLine(t *testing.T) {
+	// Test: registered code gets its standard reason phrase
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_NOT_FOUND))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", statusLine(t, w, buffer))
+
+	// Test: unregistered code keeps the separator but has no phrase
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(299))
+	assert.Equal(t, "HTTP/1.1 299 \r\n", statusLine(t, w, buffer))
+
+	// Test: custom reason phrase
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLineWithReason(STATUS_CODE_OK, "Totally Fine"))
+	assert.Equal(t, "HTTP/1.1 200 Totally Fine\r\n", statusLine(t, w, buffer))
+
+	// Test: the version follows the request
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.SetVersion("1.0"))
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n", statusLine(t, w, buffer))
+
+	// Test: invalid input is refused
+	w = NewWriter(&bytes.Buffer{})
+	assert.Error(t, w.SetVersion("2"))
+	assert.Error(t, w.WriteStatusLine(42))
+	assert.Error(t, w.WriteStatusLineWithReason(STATUS_CODE_OK, "OK\r\nX-Injected: yes"))
+	for _, reason := range []string{"O\x00K", "O\x1bK", "O\x7fK"} {
+		assert.Error(t, w.WriteStatusLineWithReason(STATUS_CODE_OK, reason), "%q", reason)
+	}
+	assert.ErrorIs(t, w.WriteStatusLine(STATUS_CODE_CONTINUE), ErrInterimStatus)
+	assert.ErrorIs(t, w.WriteHeader(199), ErrInterimStatus)
+
+	// Test: tabs and obs-text are allowed in a reason phrase
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLineWithReason(STATUS_CODE_OK, "All\tFine \xe9"))
+	assert.Equal(t, "HTTP/1.1 200 All\tFine \xe9\r\n", statusLine(t, w, buffer))
+}
+
+func TestWriterFillsInContentLength(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteBody([]byte("hello ")))
+	require.NoError(t, w.WriteBody([]byte("world")))
+	assert.False(t, w.HeadersSent())
+	assert.Empty(t, buffer.String())
+	require.NoError(t, w.Finish())
+	assert.True(t, w.HeadersSent())
+	assert.True(t, w.KeepAlive())
+
+	res, body := readResponse(t, buffer)
+	assert.Equal(t, int64(11), res.ContentLength)
+	assert.Empty(t, res.TransferEncoding)
+	assert.Equal(t, "hello world", body)
+}
+
+func TestWriterSwitchesToChunked(t *testing.T) {
+	large := strings.Repeat("x", BODY_BUFFER_SIZE)
+
+	// Test: HTTP/1.1 bodies that outgrow the buffer are chunked
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteBody([]byte(large)))
+	assert.False(t, w.HeadersSent())
+	require.NoError(t, w.WriteBody([]byte("tail")))
+	assert.True(t, w.HeadersSent())
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	res, body := readResponse(t, buffer)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, large+"tail", body)
+
+	// Test: Flush commits to chunked encoding straight away
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteBody([]byte("early")))
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buffer.String(), "5\r\nearly\r\n")
+	require.NoError(t, w.Finish())
+	res, body = readResponse(t, buffer)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, "early", body)
+
+	// Test: HTTP/1.0 has no chunked encoding, so the connection delimits the body
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.SetVersion("1.0"))
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteBody([]byte(large+"tail")))
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+	assert.NotContains(t, buffer.String(), "transfer-encoding")
+	assert.True(t, strings.HasSuffix(buffer.String(), "\r\n\r\n"+large+"tail"))
+}
+
+func TestWriterDeclaredContentLength(t *testing.T) {
+	// Test: a declared length is streamed over several writes
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(headers.GetDefaultHeaders(10)))
+	require.NoError(t, w.WriteBody([]byte("01234")))
+	assert.True(t, w.HeadersSent())
+	require.NoError(t, w.WriteBody([]byte("56789")))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+	_, body := readResponse(t, buffer)
+	assert.Equal(t, "0123456789", body)
+
+	// Test: writing past the declared length is refused
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(headers.GetDefaultHeaders(4)))
+	require.NoError(t, w.WriteBody([]byte("abc")))
+	n, err := w.Write([]byte("de"))
+	assert.Equal(t, 0, n)
+	assert.True(t, errors.Is(err, ErrContentLengthExceeded))
+
+	// Test: finishing short of the declared length fails and closes
+	w = NewWriter(&bytes.Buffer{})
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(headers.GetDefaultHeaders(4)))
+	require.NoError(t, w.WriteBody([]byte("abc")))
+	assert.True(t, errors.Is(w.Finish(), ErrBodyTooShort))
+	assert.False(t, w.KeepAlive())
+
+	// Test: an invalid declared length is refused up front
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	h := headers.NewHeaders()
+	h.Set(headers.CONTENT_LENGTH, "-1")
+	assert.True(t, errors.Is(w.WriteHeaders(h), ErrInvalidContentLength))
+}
+
+func TestWriterExplicitChunkedWithTrailers(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	h := headers.NewHeaders()
+	h.Set(headers.TRANSFER_ENCODING, "chunked")
+	h.Set("Trailer", "example-trailer")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("example-trailer", "12345")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.WriteSeparator())
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	res, body := readResponse(t, buffer)
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, "12345", res.Trailer.Get("example-trailer"))
+
+	// Test: an HTTP/1.0 client gets the chunks as plain data, delimited by
+	// closing the connection
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.SetVersion("1.0"))
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.WriteSeparator())
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+	head, body, _ := strings.Cut(buffer.String(), "\r\n\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.0 200 OK\r\n"), head)
+	assert.NotContains(t, head, "transfer-encoding")
+	assert.NotContains(t, head, "trailer")
+	assert.Contains(t, head, "connection: close")
+	assert.Equal(t, "hello world", body)
+}
+
+func TestWriterMisuse(t *testing.T) {
+	// Test: status after the body started
+	w := NewWriter(&bytes.Buffer{})
+	_, err := w.Write([]byte("x"))
+	require.NoError(t, err)
+	assert.Error(t, w.WriteHeader(STATUS_CODE_NOT_FOUND))
+
+	// Test: headers twice
+	assert.Error(t, w.WriteHeaders(headers.NewHeaders()))
+
+	// Test: writing after the response was finished
+	require.NoError(t, w.Finish())
+	_, err = w.Write([]byte("x"))
+	assert.True(t, errors.Is(err, ErrResponseDone))
+	assert.True(t, errors.Is(w.Reset(), ErrHeadersAlreadySent))
+
+	// Test: statuses without a body
+	buffer := &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_NO_CONTENT))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.Write([]byte("x"))
+	assert.True(t, errors.Is(err, ErrBodyNotAllowed))
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buffer.String(), "content-length")
+
+	// Test: pending output can be replaced until the headers are sent
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteBody([]byte("partial")))
+	require.NoError(t, w.Reset())
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_INTERNAL_SERVER_ERROR))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	res, body := readResponse(t, buffer)
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Empty(t, body)
+}
+
+func TestWriterImplicitHeaders(t *testing.T) {
+	// Test: the first write sends a 200 with the headers from Header
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.Header().Set("X-Custom", "yes")
+	_, err := w.Write([]byte("<html><body>hi</body></html>"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	res, body := readResponse(t, buffer)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "yes", res.Header.Get("X-Custom"))
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "<html><body>hi</body></html>", body)
+
+	// Test: repeated fields are sent as separate lines
+	buffer.Reset()
+	w = NewWriter(buffer)
+	w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	w.Header().Add("Set-Cookie", "b=2")
+	require.NoError(t, w.Finish())
+	res, _ = readResponse(t, buffer)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, res.Header.Values("Set-Cookie"))
+
+	// Test: WriteHeader sends the headers set before it
+	buffer.Reset()
+	w = NewWriter(buffer)
+	w.Header().Set("Content-Type", "application/json")
+	require.NoError(t, w.WriteHeader(STATUS_CODE_CREATED))
+	_, err = w.Write([]byte(`{"id":1}`))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	res, body = readResponse(t, buffer)
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equal(t, `{"id":1}`, body)
+
+	// Test: a handler that writes nothing answers an empty 200
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.Finish())
+	res, body = readResponse(t, buffer)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(0), res.ContentLength)
+	assert.Empty(t, res.Header.Get("Content-Type"))
+	assert.Empty(t, body)
+
+	// Test: a declared length is sniffed from the first write
+	buffer.Reset()
+	w = NewWriter(buffer)
+	w.Header().Set("Content-Length", "8")
+	_, err = w.Write([]byte("\x89PNG\x0D\x0A\x1A\x0A"))
+	require.NoError(t, err)
+	assert.True(t, w.HeadersSent())
+	require.NoError(t, w.Finish())
+	res, _ = readResponse(t, buffer)
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+}
+
+func TestDetectContentType(t *testing.T) {
+	mp4 := []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isommp41")
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"", "text/plain; charset=utf-8"},
+		{"hello world", "text/plain; charset=utf-8"},
+		{"  \n<!DOCTYPE html><html></html>", "text/html; charset=utf-8"},
+		{"<p>paragraph</p>", "text/html; charset=utf-8"},
+		{"<!-- comment -->", "text/html; charset=utf-8"},
+		{"<pre>not a listed tag</pre>", "text/plain; charset=utf-8"},
+		{"<?xml version=\"1.0\"?><a/>", "text/xml; charset=utf-8"},
+		{"%PDF-1.7", "application/pdf"},
+		{"GIF89a...", "image/gif"},
+		{"\xFF\xD8\xFF\xE0", "image/jpeg"},
+		{"RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{string(mp4), "video/mp4"},
+		{"\x1A\x45\xDF\xA3", "video/webm"},
+		{"PK\x03\x04", "application/zip"},
+		{"\x1F\x8B\x08", "application/x-gzip"},
+		{"\xEF\xBB\xBFbom", "text/plain; charset=utf-8"},
+		{"\x01\x02\x03", "application/octet-stream"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, DetectContentType([]byte(tc.data)), "%q", tc.data)
+	}
+}
+
+func TestWriterRejectsInvalidHeaders(t *testing.T) {
+	// Test: WriteHeaders refuses an injected field
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(STATUS_CODE_FOUND))
+	h := headers.NewHeaders()
+	h.Set("Location", "/home\r\nSet-Cookie: admin=1")
+	assert.ErrorIs(t, w.WriteHeaders(h), headers.ErrInvalidHeaderValue)
+
+	// Test: fields set through Header are checked by the implicit WriteHeader
+	w = NewWriter(buffer)
+	w.Header().Set("Bad Name", "x")
+	_, err := w.Write([]byte("body"))
+	assert.ErrorIs(t, err, headers.ErrInvalidHeaderName)
+	assert.ErrorIs(t, w.Finish(), headers.ErrInvalidHeaderName)
+	assert.False(t, w.HeadersSent())
+
+	// Test: and again when they change after WriteHeader
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteHeader(STATUS_CODE_OK))
+	w.Header().Set("X-Late", "a\rb")
+	assert.ErrorIs(t, w.Finish(), headers.ErrInvalidHeaderValue)
+	assert.False(t, w.HeadersSent())
+	assert.Empty(t, buffer.String())
+
+	// Test: trailers are checked too
+	w = NewWriter(buffer)
+	w.Header().Set(headers.TRANSFER_ENCODING, "chunked")
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc\x00")
+	assert.ErrorIs(t, w.WriteTrailers(trailers), headers.ErrInvalidHeaderValue)
+}
+
+func TestWriterOmitsBodyForHead(t *testing.T) {
+	// Test: the length of a small body is still declared
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.SetOmitBody(true)
+	_, err := w.Write([]byte("<html>hello</html>"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 18\r\ncontent-type: text/html; charset=utf-8\r\nconnection: close\r\n\r\n", buffer.String())
+
+	// Test: a large body is announced as chunked without any chunk
+	buffer.Reset()
+	w = NewWriter(buffer)
+	w.SetOmitBody(true)
+	_, err = w.Write(bytes.Repeat([]byte("x"), BODY_BUFFER_SIZE+1))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buffer.String(), "transfer-encoding: chunked\r\ncontent-type: text/plain; charset=utf-8\r\nconnection: close\r\n\r\n"), buffer.String())
+	assert.Equal(t, int64(BODY_BUFFER_SIZE+1), w.BytesWritten())
+
+	// Test: a declared length need not be matched
+	buffer.Reset()
+	w = NewWriter(buffer)
+	w.SetOmitBody(true)
+	w.SetKeepAlive(true)
+	w.Header().Set(headers.CONTENT_LENGTH, "1000")
+	require.NoError(t, w.WriteHeader(STATUS_CODE_OK))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 1000\r\nconnection: keep-alive\r\n\r\n", buffer.String())
+
+	// Test: nothing written means no length either
+	buffer.Reset()
+	w = NewWriter(buffer)
+	w.SetOmitBody(true)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nconnection: close\r\n\r\n", buffer.String())
+}
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected []ByteRange
+	}{
+		{"bytes=0-499", []ByteRange{{0, 500}}},
+		{"bytes=500-999", []ByteRange{{500, 500}}},
+		{"bytes=9500-", []ByteRange{{9500, 500}}},
+		{"bytes=-500", []ByteRange{{9500, 500}}},
+		{"bytes=-20000", []ByteRange{{0, 10000}}},
+		{"bytes=9000-20000", []ByteRange{{9000, 1000}}},
+		{"BYTES = 0-0 , ,-1", []ByteRange{{0, 1}, {9999, 1}}},
+		{"bytes=0-99,200-299,20000-", []ByteRange{{0, 100}, {200, 100}}},
+	}
+	for _, c := range cases {
+		ranges, err := ParseRange(c.value, 10000)
+		require.NoError(t, err, c.value)
+		assert.Equal(t, c.expected, ranges, c.value)
+	}
+
+	// Test: malformed ranges are ignored
+	invalid := []string{"", "bytes", "items=0-1", "bytes=", "bytes=1", "bytes=5-1", "bytes=a-b", "bytes=-", "bytes=+1-2", "bytes=0-1;2-3", "bytes=99999999999999999999-"}
+	for _, value := range invalid {
+		_, err := ParseRange(value, 10000)
+		assert.ErrorIs(t, err, ErrInvalidRange, value)
+	}
+	// Test: too many or overlapping ranges are ignored too
+	_, err := ParseRange("bytes="+strings.Repeat("0-0,", MAX_RANGES+1), 10000)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	_, err = ParseRange("bytes=0-,0-", 10000)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+
+	for _, value := range []string{"bytes=10000-", "bytes=20000-30000", "bytes=-0", "bytes=10000-,-0"} {
+		_, err := ParseRange(value, 10000)
+		assert.ErrorIs(t, err, ErrRangeNotSatisfiable, value)
+	}
+	_, err = ParseRange("bytes=-5", 0)
+	assert.ErrorIs(t, err, ErrRangeNotSatisfiable)
+}
+
+func TestWriteRanges(t *testing.T) {
+	content := strings.NewReader("0123456789abcdefghij")
+
+	// Test: a single range
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	require.NoError(t, w.WriteRanges(content, 20, "text/plain", []ByteRange{{5, 5}}))
+	require.NoError(t, w.Finish())
+	res, body := readResponse(t, buffer)
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Equal(t, "bytes 5-9/20", res.Header.Get("Content-Range"))
+	assert.Equal(t, int64(5), res.ContentLength)
+	assert.Equal(t, "56789", body)
+
+	// Test: several ranges make a multipart body of the declared length
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteRanges(content, 20, "text/plain", []ByteRange{{0, 2}, {18, 2}, {10, 1}}))
+	require.NoError(t, w.Finish())
+	res, body = readResponse(t, buffer)
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Range"))
+	assert.Equal(t, int64(len(body)), res.ContentLength)
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	expected := []struct{ contentRange, data string }{{"bytes 0-1/20", "01"}, {"bytes 18-19/20", "ij"}, {"bytes 10-10/20", "a"}}
+	for _, part := range expected {
+		p, err := reader.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain", p.Header.Get("Content-Type"))
+		assert.Equal(t, part.contentRange, p.Header.Get("Content-Range"))
+		data, err := io.ReadAll(p)
+		require.NoError(t, err)
+		assert.Equal(t, part.data, string(data))
+	}
+	_, err = reader.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: unsatisfiable ranges
+	buffer.Reset()
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteRangeNotSatisfiable(20))
+	require.NoError(t, w.Finish())
+	res, _ = readResponse(t, buffer)
+	assert.Equal(t, 416, res.StatusCode)
+	assert.Equal(t, "bytes */20", res.Header.Get("Content-Range"))
+}
+
+func TestHTTPDates(t *testing.T) {
+	expected := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatHTTPDate(expected.In(time.FixedZone("CET", 3600))))
+	for _, value := range []string{"Sun, 06 Nov 1994 08:49:37 GMT", "Sunday, 06-Nov-94 08:49:37 GMT", "Sun Nov  6 08:49:37 1994"} {
+		date, err := ParseHTTPDate(value)
+		require.NoError(t, err, value)
+		assert.True(t, expected.Equal(date), value)
+	}
+	_, err := ParseHTTPDate("yesterday")
+	assert.Error(t, err)
+}
+
+func TestETags(t *testing.T) {
+	etag := StrongETag([]byte("hello"))
+	assert.Equal(t, etag, StrongETag([]byte("hello")))
+	assert.NotEqual(t, etag, StrongETag([]byte("hello!")))
+	assert.True(t, strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`), etag)
+
+	modTime := time.Unix(1700000000, 5)
+	assert.Equal(t, `W/"17979cfe362a0005-14"`, WeakETag(modTime, 20))
+	assert.NotEqual(t, WeakETag(modTime, 20), WeakETag(modTime, 21))
+}
+
+func TestEvaluatePreconditions(t *testing.T) {
+	etag := `"v2"`
+	lastModified := time.Date(2024, time.March, 1, 12, 0, 0, 500, time.UTC)
+	before := "Fri, 01 Mar 2024 11:00:00 GMT"
+	exact := "Fri, 01 Mar 2024 12:00:00 GMT"
+	after := "Fri, 01 Mar 2024 13:00:00 GMT"
+
+	cases := []struct {
+		method   string
+		fields   [][2]string
+		expected StatusCode
+	}{
+		{"GET", nil, 0},
+		{"GET", [][2]string{{"If-None-Match", `"v2"`}}, STATUS_CODE_NOT_MODIFIED},
+		{"HEAD", [][2]string{{"If-None-Match", `"v1", W/"v2"`}}, STATUS_CODE_NOT_MODIFIED},
+		{"GET", [][2]string{{"If-None-Match", "*"}}, STATUS_CODE_NOT_MODIFIED},
+		{"GET", [][2]string{{"If-None-Match", `"v1"`}}, 0},
+		{"PUT", [][2]string{{"If-None-Match", "*"}}, STATUS_CODE_PRECONDITION_FAILED},
+		{"GET", [][2]string{{"If-Modified-Since", exact}}, STATUS_CODE_NOT_MODIFIED},
+		{"GET", [][2]string{{"If-Modified-Since", after}}, STATUS_CODE_NOT_MODIFIED},
+		{"GET", [][2]string{{"If-Modified-Since", before}}, 0},
+		{"GET", [][2]string{{"If-Modified-Since", "not a date"}}, 0},
+		{"POST", [][2]string{{"If-Modified-Since", exact}}, 0},
+		// If-None-Match takes precedence over If-Modified-Since
+		{"GET", [][2]string{{"If-None-Match", `"v1"`}, {"If-Modified-Since", after}}, 0},
+		{"PUT", [][2]string{{"If-Match", `"v2"`}}, 0},
+		{"PUT", [][2]string{{"If-Match", `"v1", "v2"`}}, 0},
+		{"PUT", [][2]string{{"If-Match", "*"}}, 0},
+		{"PUT", [][2]string{{"If-Match", `"v1"`}}, STATUS_CODE_PRECONDITION_FAILED},
+		// If-Match compares strongly
+		{"PUT", [][2]string{{"If-Match", `W/"v2"`}}, STATUS_CODE_PRECONDITION_FAILED},
+		{"PUT", [][2]string{{"If-Match", `"v2`}}, STATUS_CODE_PRECONDITION_FAILED},
+		{"PUT", [][2]string{{"If-Unmodified-Since", exact}}, 0},
+		{"PUT", [][2]string{{"If-Unmodified-Since", before}}, STATUS_CODE_PRECONDITION_FAILED},
+		// If-Match takes precedence over If-Unmodified-Since
+		{"PUT", [][2]string{{"If-Match", `"v2"`}, {"If-Unmodified-Since", before}}, 0},
+		{"GET", [][2]string{{"If-Match", `"v1"`}, {"If-None-Match", `"v2"`}}, STATUS_CODE_PRECONDITION_FAILED},
+		{"GET", [][2]string{{"If-Match", `"v2"`}, {"If-None-Match", `"v2"`}}, STATUS_CODE_NOT_MODIFIED},
+	}
+	for _, c := range cases {
+		h := headers.NewHeaders()
+		for _, field := range c.fields {
+			h.Add(field[0], field[1])
+		}
+		assert.Equal(t, c.expected, EvaluatePreconditions(c.method, h, etag, lastModified), "%v %v", c.method, c.fields)
+	}
+
+	// Test: missing validators
+	h := headers.NewHeaders()
+	h.Set("If-Modified-Since", after)
+	assert.Equal(t, StatusCode(0), EvaluatePreconditions("GET", h, etag, time.Time{}))
+	h = headers.NewHeaders()
+	h.Set("If-Match", `"v2"`)
+	assert.Equal(t, STATUS_CODE_PRECONDITION_FAILED, EvaluatePreconditions("PUT", h, "", lastModified))
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	lastModified := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	assert.True(t, IfRangeMatches(`"v2"`, `"v2"`, lastModified))
+	assert.False(t, IfRangeMatches(`"v1"`, `"v2"`, lastModified))
+	assert.False(t, IfRangeMatches(`W/"v2"`, `W/"v2"`, lastModified))
+	assert.True(t, IfRangeMatches("Fri, 01 Mar 2024 12:00:00 GMT", `"v2"`, lastModified))
+	assert.False(t, IfRangeMatches("Fri, 01 Mar 2024 13:00:00 GMT", `"v2"`, lastModified))
+	assert.False(t, IfRangeMatches("Fri, 01 Mar 2024 12:00:00 GMT", `"v2"`, time.Time{}))
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	lastModified := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	h := headers.NewHeaders()
+	h.Set("If-None-Match", `"v2"`)
+
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	done, err := w.CheckPreconditions("GET", h, `"v2"`, lastModified)
+	require.NoError(t, err)
+	assert.True(t, done)
+	require.NoError(t, w.Finish())
+	res, body := readResponse(t, buffer)
+	assert.Equal(t, 304, res.StatusCode)
+	assert.Equal(t, `"v2"`, res.Header.Get("ETag"))
+	assert.Equal(t, "Fri, 01 Mar 2024 12:00:00 GMT", res.Header.Get("Last-Modified"))
+	assert.Empty(t, body)
+
+	// Test: a request that may proceed only gets the validators set
+	buffer.Reset()
+	w = NewWriter(buffer)
+	done, err = w.CheckPreconditions("GET", headers.NewHeaders(), "", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.False(t, done)
+	_, hasETag := w.Header().Get("ETag")
+	assert.False(t, hasETag)
+	value, _ := w.Header().Get("Last-Modified")
+	date, err := ParseHTTPDate(value)
+	require.NoError(t, err)
+	assert.False(t, date.After(time.Now()), "Last-Modified must not be in the future")
+
+	buffer.Reset()
+	w = NewWriter(buffer)
+	h = headers.NewHeaders()
+	h.Set("If-Unmodified-Since", "Fri, 01 Mar 2024 11:00:00 GMT")
+	done, err = w.CheckPreconditions("DELETE", h, `"v2"`, lastModified)
+	require.NoError(t, err)
+	assert.True(t, done)
+	require.NoError(t, w.Finish())
+	res, _ = readResponse(t, buffer)
+	assert.Equal(t, 412, res.StatusCode)
+}
@@ -0,0 +1,142 @@
+package response
+
+import (
+	"bytes"
+)
+
+// SNIFF_LENGTH is how many leading body bytes DetectContentType looks at.
+const SNIFF_LENGTH = 512
+
+const (
+	textPlain   = "text/plain; charset=utf-8"
+	octetStream = "application/octet-stream"
+)
+
+// htmlTags are the tags that mark a document as HTML when they open it, after
+// optional whitespace, and are followed by a space or '>'.
+var htmlTags = []string{
+	"<!DOCTYPE HTML", "<HTML", "<HEAD", "<SCRIPT", "<IFRAME", "<H1", "<DIV",
+	"<FONT", "<TABLE", "<A", "<STYLE", "<TITLE", "<B", "<BODY", "<BR", "<P", "<!--",
+}
+
+type signature struct {
+	prefix      string
+	contentType string
+}
+
+// signatures are matched against the very first bytes of the body.
+var signatures = []signature{
+	{"%PDF-", "application/pdf"},
+	{"%!PS-Adobe-", "application/postscript"},
+	{"\xFE\xFF", "text/plain; charset=utf-16be"},
+	{"\xFF\xFE", "text/plain; charset=utf-16le"},
+	{"\xEF\xBB\xBF", textPlain},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"\x89PNG\x0D\x0A\x1A\x0A", "image/png"},
+	{"\xFF\xD8\xFF", "image/jpeg"},
+	{"BM", "image/bmp"},
+	{"\x00\x00\x01\x00", "image/x-icon"},
+	{"\x1A\x45\xDF\xA3", "video/webm"},
+	{"OggS\x00", "application/ogg"},
+	{"ID3", "audio/mpeg"},
+	{"fLaC", "audio/flac"},
+	{"PK\x03\x04", "application/zip"},
+	{"\x1F\x8B\x08", "application/x-gzip"},
+	{"Rar!\x1A\x07", "application/x-rar-compressed"},
+	{"\x00asm", "application/wasm"},
+	{"wOFF", "font/woff"},
+	{"wOF2", "font/woff2"},
+}
+
+// DetectContentType guesses the media type of a body from its first bytes,
+// following the outline of the WHATWG MIME sniffing algorithm. It never
+// fails: unknown text is text/plain and unknown binary data is
+// application/octet-stream.
+func DetectContentType(data []byte) string {
+	if len(data) > SNIFF_LENGTH {
+		data = data[:SNIFF_LENGTH]
+	}
+	for _, s := range signatures {
+		if bytes.HasPrefix(data, []byte(s.prefix)) {
+			return s.contentType
+		}
+	}
+	if isRIFF(data, "WEBPVP") {
+		return "image/webp"
+	}
+	if isRIFF(data, "WAVE") {
+		return "audio/wave"
+	}
+	if isRIFF(data, "AVI ") {
+		return "video/avi"
+	}
+	if isMP4(data) {
+		return "video/mp4"
+	}
+
+	markup := bytes.TrimLeft(data, "\t\n\x0C\r ")
+	for _, tag := range htmlTags {
+		if hasTag(markup, tag) {
+			return "text/html; charset=utf-8"
+		}
+	}
+	if bytes.HasPrefix(markup, []byte("<?xml")) {
+		return "text/xml; charset=utf-8"
+	}
+
+	for _, b := range data {
+		if isBinaryByte(b) {
+			return octetStream
+		}
+	}
+	return textPlain
+}
+
+// hasTag reports whether data opens with tag, compared case-insensitively
+// and terminated by a space or '>'.
+func hasTag(data []byte, tag string) bool {
+	if len(data) < len(tag)+1 || !bytes.EqualFold(data[:len(tag)], []byte(tag)) {
+		return false
+	}
+	if tag == "<!--" {
+		return true
+	}
+	next := data[len(tag)]
+	return next == ' ' || next == '>'
+}
+
+// isRIFF reports whether data is a RIFF container of the given form type.
+func isRIFF(data []byte, form string) bool {
+	return len(data) >= 8+len(form) &&
+		bytes.HasPrefix(data, []byte("RIFF")) &&
+		bytes.Equal(data[8:8+len(form)], []byte(form))
+}
+
+// isMP4 looks for an ftyp box whose major or compatible brands start with
+// "mp4".
+func isMP4(data []byte) bool {
+	if len(data) < 12 {
+		return false
+	}
+	boxSize := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if boxSize%4 != 0 || len(data) < boxSize || !bytes.Equal(data[4:8], []byte("ftyp")) {
+		return false
+	}
+	for i := 8; i+3 <= boxSize; i += 4 {
+		if i == 12 {
+			// Skip the minor version.
+			continue
+		}
+		if bytes.Equal(data[i:i+3], []byte("mp4")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBinaryByte reports whether b is a control character that doesn't occur
+// in text.
+func isBinaryByte(b byte) bool {
+	return b <= 0x08 || b == 0x0B || (b >= 0x0E && b <= 0x1A) || (b >= 0x1C && b <= 0x1F)
+}
@@ -0,0 +1,147 @@
+package response
+
+type StatusCode int
+
+// Status codes registered with IANA, see
+// https://www.iana.org/assignments/http-status-codes
+const (
+	STATUS_CODE_CONTINUE            StatusCode = 100
+	STATUS_CODE_SWITCHING_PROTOCOLS StatusCode = 101
+	STATUS_CODE_PROCESSING          StatusCode = 102
+	STATUS_CODE_EARLY_HINTS         StatusCode = 103
+
+	STATUS_CODE_OK                            StatusCode = 200
+	STATUS_CODE_CREATED                       StatusCode = 201
+	STATUS_CODE_ACCEPTED                      StatusCode = 202
+	STATUS_CODE_NON_AUTHORITATIVE_INFORMATION StatusCode = 203
+	STATUS_CODE_NO_CONTENT                    StatusCode = 204
+	STATUS_CODE_RESET_CONTENT                 StatusCode = 205
+	STATUS_CODE_PARTIAL_CONTENT               StatusCode = 206
+	STATUS_CODE_MULTI_STATUS                  StatusCode = 207
+	STATUS_CODE_ALREADY_REPORTED              StatusCode = 208
+	STATUS_CODE_IM_USED                       StatusCode = 226
+
+	STATUS_CODE_MULTIPLE_CHOICES   StatusCode = 300
+	STATUS_CODE_MOVED_PERMANENTLY  StatusCode = 301
+	STATUS_CODE_FOUND              StatusCode = 302
+	STATUS_CODE_SEE_OTHER          StatusCode = 303
+	STATUS_CODE_NOT_MODIFIED       StatusCode = 304
+	STATUS_CODE_USE_PROXY          StatusCode = 305
+	STATUS_CODE_TEMPORARY_REDIRECT StatusCode = 307
+	STATUS_CODE_PERMANENT_REDIRECT StatusCode = 308
+
+	STATUS_CODE_BAD_REQUEST                   StatusCode = 400
+	STATUS_CODE_UNAUTHORIZED                  StatusCode = 401
+	STATUS_CODE_PAYMENT_REQUIRED              StatusCode = 402
+	STATUS_CODE_FORBIDDEN                     StatusCode = 403
+	STATUS_CODE_NOT_FOUND                     StatusCode = 404
+	STATUS_CODE_METHOD_NOT_ALLOWED            StatusCode = 405
+	STATUS_CODE_NOT_ACCEPTABLE                StatusCode = 406
+	STATUS_CODE_PROXY_AUTHENTICATION_REQUIRED StatusCode = 407
+	STATUS_CODE_REQUEST_TIMEOUT               StatusCode = 408
+	STATUS_CODE_CONFLICT                      StatusCode = 409
+	STATUS_CODE_GONE                          StatusCode = 410
+	STATUS_CODE_LENGTH_REQUIRED               StatusCode = 411
+	STATUS_CODE_PRECONDITION_FAILED           StatusCode = 412
+	STATUS_CODE_CONTENT_TOO_LARGE             StatusCode = 413
+	STATUS_CODE_URI_TOO_LONG                  StatusCode = 414
+	STATUS_CODE_UNSUPPORTED_MEDIA_TYPE        StatusCode = 415
+	STATUS_CODE_RANGE_NOT_SATISFIABLE         StatusCode = 416
+	STATUS_CODE_EXPECTATION_FAILED            StatusCode = 417
+	STATUS_CODE_MISDIRECTED_REQUEST           StatusCode = 421
+	STATUS_CODE_UNPROCESSABLE_CONTENT         StatusCode = 422
+	STATUS_CODE_LOCKED                        StatusCode = 423
+	STATUS_CODE_FAILED_DEPENDENCY             StatusCode = 424
+	STATUS_CODE_TOO_EARLY                     StatusCode = 425
+	STATUS_CODE_UPGRADE_REQUIRED              StatusCode = 426
+	STATUS_CODE_PRECONDITION_REQUIRED         StatusCode = 428
+	STATUS_CODE_TOO_MANY_REQUESTS             StatusCode = 429
+	STATUS_CODE_HEADERS_TOO_LARGE             StatusCode = 431
+	STATUS_CODE_UNAVAILABLE_FOR_LEGAL_REASONS StatusCode = 451
+
+	STATUS_CODE_INTERNAL_SERVER_ERROR           StatusCode = 500
+	STATUS_CODE_NOT_IMPLEMENTED                 StatusCode = 501
+	STATUS_CODE_BAD_GATEWAY                     StatusCode = 502
+	STATUS_CODE_SERVICE_UNAVAILABLE             StatusCode = 503
+	STATUS_CODE_GATEWAY_TIMEOUT                 StatusCode = 504
+	STATUS_CODE_VERSION_NOT_SUPPORTED           StatusCode = 505
+	STATUS_CODE_VARIANT_ALSO_NEGOTIATES         StatusCode = 506
+	STATUS_CODE_INSUFFICIENT_STORAGE            StatusCode = 507
+	STATUS_CODE_LOOP_DETECTED                   StatusCode = 508
+	STATUS_CODE_NOT_EXTENDED                    StatusCode = 510
+	STATUS_CODE_NETWORK_AUTHENTICATION_REQUIRED StatusCode = 511
+)
+
+var statusText = map[StatusCode]string{
+	STATUS_CODE_CONTINUE:            "Continue",
+	STATUS_CODE_SWITCHING_PROTOCOLS: "Switching Protocols",
+	STATUS_CODE_PROCESSING:          "Processing",
+	STATUS_CODE_EARLY_HINTS:         "Early Hints",
+
+	STATUS_CODE_OK:                            "OK",
+	STATUS_CODE_CREATED:                       "Created",
+	STATUS_CODE_ACCEPTED:                      "Accepted",
+	STATUS_CODE_NON_AUTHORITATIVE_INFORMATION: "Non-Authoritative Information",
+	STATUS_CODE_NO_CONTENT:                    "No Content",
+	STATUS_CODE_RESET_CONTENT:                 "Reset Content",
+	STATUS_CODE_PARTIAL_CONTENT:               "Partial Content",
+	STATUS_CODE_MULTI_STATUS:                  "Multi-Status",
+	STATUS_CODE_ALREADY_REPORTED:              "Already Reported",
+	STATUS_CODE_IM_USED:                       "IM Used",
+
+	STATUS_CODE_MULTIPLE_CHOICES:   "Multiple Choices",
+	STATUS_CODE_MOVED_PERMANENTLY:  "Moved Permanently",
+	STATUS_CODE_FOUND:              "Found",
+	STATUS_CODE_SEE_OTHER:          "See Other",
+	STATUS_CODE_NOT_MODIFIED:       "Not Modified",
+	STATUS_CODE_USE_PROXY:          "Use Proxy",
+	STATUS_CODE_TEMPORARY_REDIRECT: "Temporary Redirect",
+	STATUS_CODE_PERMANENT_REDIRECT: "Permanent Redirect",
+
+	STATUS_CODE_BAD_REQUEST:                   "Bad Request",
+	STATUS_CODE_UNAUTHORIZED:                  "Unauthorized",
+	STATUS_CODE_PAYMENT_REQUIRED:              "Payment Required",
+	STATUS_CODE_FORBIDDEN:                     "Forbidden",
+	STATUS_CODE_NOT_FOUND:                     "Not Found",
+	STATUS_CODE_METHOD_NOT_ALLOWED:            "Method Not Allowed",
+	STATUS_CODE_NOT_ACCEPTABLE:                "Not Acceptable",
+	STATUS_CODE_PROXY_AUTHENTICATION_REQUIRED: "Proxy Authentication Required",
+	STATUS_CODE_REQUEST_TIMEOUT:               "Request Timeout",
+	STATUS_CODE_CONFLICT:                      "Conflict",
+	STATUS_CODE_GONE:                          "Gone",
+	STATUS_CODE_LENGTH_REQUIRED:               "Length Required",
+	STATUS_CODE_PRECONDITION_FAILED:           "Precondition Failed",
+	STATUS_CODE_CONTENT_TOO_LARGE:             "Content Too Large",
+	STATUS_CODE_URI_TOO_LONG:                  "URI Too Long",
+	STATUS_CODE_UNSUPPORTED_MEDIA_TYPE:        "Unsupported Media Type",
+	STATUS_CODE_RANGE_NOT_SATISFIABLE:         "Range Not Satisfiable",
+	STATUS_CODE_EXPECTATION_FAILED:            "Expectation Failed",
+	STATUS_CODE_MISDIRECTED_REQUEST:           "Misdirected Request",
+	STATUS_CODE_UNPROCESSABLE_CONTENT:         "Unprocessable Content",
+	STATUS_CODE_LOCKED:                        "Locked",
+	STATUS_CODE_FAILED_DEPENDENCY:             "Failed Dependency",
+	STATUS_CODE_TOO_EARLY:                     "Too Early",
+	STATUS_CODE_UPGRADE_REQUIRED:              "Upgrade Required",
+	STATUS_CODE_PRECONDITION_REQUIRED:         "Precondition Required",
+	STATUS_CODE_TOO_MANY_REQUESTS:             "Too Many Requests",
+	STATUS_CODE_HEADERS_TOO_LARGE:             "Request Header Fields Too Large",
+	STATUS_CODE_UNAVAILABLE_FOR_LEGAL_REASONS: "Unavailable For Legal Reasons",
+
+	STATUS_CODE_INTERNAL_SERVER_ERROR:           "Internal Server Error",
+	STATUS_CODE_NOT_IMPLEMENTED:                 "Not Implemented",
+	STATUS_CODE_BAD_GATEWAY:                     "Bad Gateway",
+	STATUS_CODE_SERVICE_UNAVAILABLE:             "Service Unavailable",
+	STATUS_CODE_GATEWAY_TIMEOUT:                 "Gateway Timeout",
+	STATUS_CODE_VERSION_NOT_SUPPORTED:           "HTTP Version Not Supported",
+	STATUS_CODE_VARIANT_ALSO_NEGOTIATES:         "Variant Also Negotiates",
+	STATUS_CODE_INSUFFICIENT_STORAGE:            "Insufficient Storage",
+	STATUS_CODE_LOOP_DETECTED:                   "Loop Detected",
+	STATUS_CODE_NOT_EXTENDED:                    "Not Extended",
+	STATUS_CODE_NETWORK_AUTHENTICATION_REQUIRED: "Network Authentication Required",
+}
+
+// StatusText returns the standard reason phrase for a status code, or an
+// empty string when the code is not registered.
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
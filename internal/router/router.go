@@ -0,0 +1,312 @@
+// Package router dispatches requests to server.Handlers by method and path.
+//
+// A pattern is a path whose segments are either literal text, a wildcard
+// {name} matching exactly one non-empty segment, or a trailing {name...}
+// matching the rest of the path. Matched values are read with
+// request.Request.PathValue. When several patterns match, the most specific
+// one wins: at the first segment where they differ a literal beats {name},
+// which beats {name...}.
+package router
+
+import (
+	"fmt"
+	"httpFromTCP/internal/request"
+	"httpFromTCP/internal/response"
+	"httpFromTCP/internal/server"
+	"slices"
+	"strings"
+)
+
+const notFoundMessage = "no resource matches the request path"
+const methodNotAllowedMessage = "the resource does not support the request method"
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentWildcard
+	segmentRest
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the literal text, or the wildcard name.
+	value string
+}
+
+type route struct {
+	pattern  string
+	segments []segment
+	handlers map[string]server.Handler
+}
+
+// table holds the routes shared by a router and its groups.
+type table struct {
+	routes   []*route
+	notFound server.Handler
+}
+
+// Router is a server.Handler registry. Routes have to be registered before
+// the router starts serving, registering concurrently with ServeRequest is
+// not safe.
+type Router struct {
+	prefix string
+	table  *table
+}
+
+func New() *Router {
+	return &Router{table: &table{}}
+}
+
+// Group returns a router whose patterns all start with prefix. It registers
+// into the same routes as rt.
+func (rt *Router) Group(prefix string) *Router {
+	if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		panic(fmt.Sprintf("router: group prefix %q must start and must not end with /", prefix))
+	}
+	return &Router{prefix: rt.prefix + prefix, table: rt.table}
+}
+
+// NotFound sets the handler for paths no route matches. By default they are
+// answered with a 404.
+func (rt *Router) NotFound(handler server.Handler) {
+	rt.table.notFound = handler
+}
+
+// Handle registers handler for requests with the given method whose path
+// matches pattern. It panics when the pattern is malformed or the method
+// was already registered for it.
+func (rt *Router) Handle(method string, pattern string, handler server.Handler) {
+	pattern = rt.prefix + pattern
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	index := slices.IndexFunc(rt.table.routes, func(r *route) bool {
+		return sameShape(r.segments, segments)
+	})
+	if index != -1 && !slices.Equal(rt.table.routes[index].segments, segments) {
+		panic(fmt.Sprintf("router: pattern %v conflicts with %v", pattern, rt.table.routes[index].pattern))
+	}
+	if index == -1 {
+		rt.table.routes = append(rt.table.routes, &route{pattern: pattern, segments: segments, handlers: make(map[string]server.Handler)})
+		index = len(rt.table.routes) - 1
+	}
+	r := rt.table.routes[index]
+	if _, ok := r.handlers[method]; ok {
+		panic(fmt.Sprintf("router: %v %v is already registered", method, pattern))
+	}
+	r.handlers[method] = handler
+}
+
+func (rt *Router) Get(pattern string, handler server.Handler) {
+	rt.Handle("GET", pattern, handler)
+}
+
+func (rt *Router) Head(pattern string, handler server.Handler) {
+	rt.Handle("HEAD", pattern, handler)
+}
+
+func (rt *Router) Post(pattern string, handler server.Handler) {
+	rt.Handle("POST", pattern, handler)
+}
+
+func (rt *Router) Put(pattern string, handler server.Handler) {
+	rt.Handle("PUT", pattern, handler)
+}
+
+func (rt *Router) Patch(pattern string, handler server.Handler) {
+	rt.Handle("PATCH", pattern, handler)
+}
+
+func (rt *Router) Delete(pattern string, handler server.Handler) {
+	rt.Handle("DELETE", pattern, handler)
+}
+
+// ServeRequest is the server.Handler dispatching to the registered routes.
+// A path that no route matches gets a 404, a path that only matches for
+// other methods gets a 405 listing them in Allow. HEAD requests go to the GET
+// handler of a route without a HEAD handler, the writer leaving out the
+// body. OPTIONS requests are answered with the allowed methods unless a
+// route handles them itself.
+func (rt *Router) ServeRequest(w *response.Writer, req *request.Request) *server.HandlerError {
+	method := req.RequestLine.Method
+	allowed := map[string]bool{}
+	if req.URL.Form == request.AsteriskForm {
+		// OPTIONS * asks about the server as a whole.
+		for _, r := range rt.table.routes {
+			r.addAllowed(allowed)
+		}
+		return writeAllowed(w, allowed, response.STATUS_CODE_NO_CONTENT, "")
+	}
+
+	segments := req.URL.Segments()
+	var best *route
+	var bestValues []string
+	for _, r := range rt.table.routes {
+		values, ok := r.match(segments)
+		if !ok {
+			continue
+		}
+		r.addAllowed(allowed)
+		if r.handler(method) == nil {
+			continue
+		}
+		if best == nil || r.moreSpecific(best) {
+			best, bestValues = r, values
+		}
+	}
+
+	switch {
+	case best != nil:
+		names := best.wildcardNames()
+		for i, value := range bestValues {
+			req.SetPathValue(names[i], value)
+		}
+		return best.handler(method)(w, req)
+	case len(allowed) == 0:
+		if rt.table.notFound != nil {
+			return rt.table.notFound(w, req)
+		}
+		return &server.HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: notFoundMessage}
+	case method == "OPTIONS":
+		return writeAllowed(w, allowed, response.STATUS_CODE_NO_CONTENT, "")
+	}
+	return writeAllowed(w, allowed, response.STATUS_CODE_METHOD_NOT_ALLOWED, methodNotAllowedMessage)
+}
+
+// handler returns the handler of the route for method, or nil when it has
+// none. HEAD falls back to GET.
+func (r *route) handler(method string) server.Handler {
+	if handler, ok := r.handlers[method]; ok {
+		return handler
+	}
+	if method == "HEAD" {
+		return r.handlers["GET"]
+	}
+	return nil
+}
+
+// addAllowed adds the methods the route handles to allowed.
+func (r *route) addAllowed(allowed map[string]bool) {
+	for m := range r.handlers {
+		allowed[m] = true
+	}
+	if _, ok := r.handlers["GET"]; ok {
+		allowed["HEAD"] = true
+	}
+}
+
+// writeAllowed answers with the given status and an Allow header listing the
+// methods, which always include OPTIONS.
+func writeAllowed(w *response.Writer, allowed map[string]bool, statusCode response.StatusCode, message string) *server.HandlerError {
+	allowed["OPTIONS"] = true
+	methods := make([]string, 0, len(allowed))
+	for m := range allowed {
+		methods = append(methods, m)
+	}
+	slices.Sort(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	if message != "" {
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	if err := w.WriteHeader(statusCode); err != nil {
+		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	if _, err := w.Write([]byte(message)); err != nil {
+		return &server.HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	return nil
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("router: pattern %q must start with /", pattern)
+	}
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	names := map[string]bool{}
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("router: pattern %q has a brace inside a segment", pattern)
+			}
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+			continue
+		}
+		if !strings.HasSuffix(part, "}") {
+			return nil, fmt.Errorf("router: pattern %q has an unterminated wildcard", pattern)
+		}
+		name := part[1 : len(part)-1]
+		kind := segmentWildcard
+		if rest, ok := strings.CutSuffix(name, "..."); ok {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("router: pattern %q has %v before its end", pattern, part)
+			}
+			name, kind = rest, segmentRest
+		}
+		if name == "" || strings.ContainsAny(name, "{}.") {
+			return nil, fmt.Errorf("router: pattern %q has an invalid wildcard name %q", pattern, name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("router: pattern %q uses the wildcard %v twice", pattern, name)
+		}
+		names[name] = true
+		segments = append(segments, segment{kind: kind, value: name})
+	}
+	return segments, nil
+}
+
+// sameShape reports whether two patterns match the same paths, which is when
+// they only differ in wildcard names.
+func sameShape(a, b []segment) bool {
+	return slices.EqualFunc(a, b, func(x, y segment) bool {
+		return x.kind == y.kind && (x.kind != segmentLiteral || x.value == y.value)
+	})
+}
+
+// match reports whether the path segments match the route, along with the
+// values of its wildcards in order.
+func (r *route) match(path []string) ([]string, bool) {
+	var values []string
+	for i, s := range r.segments {
+		if i >= len(path) {
+			return nil, false
+		}
+		switch s.kind {
+		case segmentLiteral:
+			if path[i] != s.value {
+				return nil, false
+			}
+		case segmentWildcard:
+			if path[i] == "" {
+				return nil, false
+			}
+			values = append(values, path[i])
+		case segmentRest:
+			return append(values, strings.Join(path[i:], "/")), true
+		}
+	}
+	return values, len(path) == len(r.segments)
+}
+
+// moreSpecific reports whether r takes precedence over other when both match
+// the same path.
+func (r *route) moreSpecific(other *route) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	return len(r.segments) < len(other.segments)
+}
+
+func (r *route) wildcardNames() []string {
+	var names []string
+	for _, s := range r.segments {
+		if s.kind != segmentLiteral {
+			names = append(names, s.value)
+		}
+	}
+	return names
+}
@@ -0,0 +1,185 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"httpFromTCP/internal/request"
+	"httpFromTCP/internal/response"
+	"httpFromTCP/internal/server"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request through the router. It returns the handler error, or
+// the response that was written when there is none.
+func serve(t *testing.T, rt *Router, method, target string) (*http.Response, string, *server.HandlerError) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	buffer := &bytes.Buffer{}
+	w := response.NewWriter(buffer)
+	w.SetOmitBody(method == "HEAD")
+	handlerErr := rt.ServeRequest(w, req)
+	if handlerErr != nil {
+		return nil, "", handlerErr
+	}
+	require.NoError(t, w.Finish())
+	res, err := http.ReadResponse(bufio.NewReader(buffer), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body), nil
+}
+
+// reply answers with its name followed by the path values it was given.
+func reply(name string, params ...string) server.Handler {
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		body := name
+		for _, param := range params {
+			body += " " + param + "=" + req.PathValue(param)
+		}
+		w.Write([]byte(body))
+		return nil
+	}
+}
+
+func TestRouting(t *testing.T) {
+	rt := New()
+	rt.Get("/", reply("root"))
+	rt.Get("/users", reply("list"))
+	rt.Post("/users", reply("create"))
+	rt.Get("/users/{id}", reply("show", "id"))
+	rt.Get("/users/me", reply("me"))
+	rt.Delete("/users/{id}", reply("delete", "id"))
+	rt.Get("/users/{id}/posts/{post}", reply("post", "id", "post"))
+	rt.Get("/files/{path...}", reply("file", "path"))
+
+	cases := []struct {
+		method   string
+		target   string
+		expected string
+	}{
+		{"GET", "/", "root"},
+		{"GET", "/users", "list"},
+		{"POST", "/users", "create"},
+		{"GET", "/users/42", "show id=42"},
+		{"GET", "/users/42?verbose=1", "show id=42"},
+		{"GET", "/users/me", "me"},
+		{"DELETE", "/users/me", "delete id=me"},
+		{"GET", "/users/a%2Fb", "show id=a/b"},
+		{"GET", "/users/7/posts/hello%20world", "post id=7 post=hello world"},
+		{"GET", "/files/css/site.css", "file path=css/site.css"},
+		{"GET", "/files/", "file path="},
+	}
+	for _, c := range cases {
+		res, body, handlerErr := serve(t, rt, c.method, c.target)
+		require.Nil(t, handlerErr, "%v %v", c.method, c.target)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, c.expected, body, "%v %v", c.method, c.target)
+	}
+
+	// Test: unknown paths are not found
+	for _, target := range []string{"/nope", "/users/42/extra", "/users/", "/files"} {
+		_, _, handlerErr := serve(t, rt, "GET", target)
+		require.NotNil(t, handlerErr, target)
+		assert.Equal(t, response.STATUS_CODE_NOT_FOUND, handlerErr.Code, target)
+	}
+}
+
+func TestMethodNotAllowedAndOptions(t *testing.T) {
+	rt := New()
+	rt.Get("/users/{id}", reply("show"))
+	rt.Delete("/users/{id}", reply("delete"))
+	rt.Post("/users", reply("create"))
+
+	// Test: a known path with the wrong method
+	res, body, handlerErr := serve(t, rt, "PUT", "/users/1")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 405, res.StatusCode)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS", res.Header.Get("Allow"))
+	assert.Equal(t, methodNotAllowedMessage, body)
+
+	// Test: automatic OPTIONS
+	res, body, handlerErr = serve(t, rt, "OPTIONS", "/users/1")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS", res.Header.Get("Allow"))
+	assert.Empty(t, body)
+
+	// Test: OPTIONS * lists every method of the server
+	res, _, handlerErr = serve(t, rt, "OPTIONS", "*")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS, POST", res.Header.Get("Allow"))
+
+	// Test: HEAD is answered by the GET handler, without the body
+	res, body, handlerErr = serve(t, rt, "HEAD", "/users/1")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(len("show")), res.ContentLength)
+	assert.Empty(t, body)
+	_, _, handlerErr = serve(t, rt, "HEAD", "/nope")
+	require.NotNil(t, handlerErr)
+	assert.Equal(t, response.STATUS_CODE_NOT_FOUND, handlerErr.Code)
+
+	// Test: an explicit HEAD route wins
+	rt.Head("/users/{id}", reply("head"))
+	res, _, handlerErr = serve(t, rt, "HEAD", "/users/1")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, int64(len("head")), res.ContentLength)
+
+	// Test: an explicit OPTIONS route wins
+	rt.Handle("OPTIONS", "/users", reply("options"))
+	_, body, handlerErr = serve(t, rt, "OPTIONS", "/users")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "options", body)
+}
+
+func TestGroupsAndNotFound(t *testing.T) {
+	rt := New()
+	api := rt.Group("/api")
+	v1 := api.Group("/v1")
+	v1.Get("/users/{id}", reply("v1 user", "id"))
+	api.Get("/health", reply("health"))
+	rt.NotFound(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteHeader(response.STATUS_CODE_NOT_FOUND)
+		w.Write([]byte("custom " + req.URL.Path))
+		return nil
+	})
+
+	_, body, handlerErr := serve(t, rt, "GET", "/api/v1/users/3")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "v1 user id=3", body)
+	_, body, handlerErr = serve(t, rt, "GET", "/api/health")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, "health", body)
+
+	res, body, handlerErr := serve(t, rt, "GET", "/v1/users/3")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "custom /v1/users/3", body)
+}
+
+func TestInvalidPatternsPanic(t *testing.T) {
+	rt := New()
+	rt.Get("/users/{id}", reply("show"))
+	invalid := []func(){
+		func() { rt.Get("users", reply("x")) },
+		func() { rt.Get("/users/{id", reply("x")) },
+		func() { rt.Get("/users/x{id}", reply("x")) },
+		func() { rt.Get("/files/{path...}/more", reply("x")) },
+		func() { rt.Get("/a/{x}/{x}", reply("x")) },
+		func() { rt.Get("/a/{}", reply("x")) },
+		func() { rt.Get("/users/{id}", reply("x")) },
+		func() { rt.Post("/users/{name}", reply("x")) },
+		func() { rt.Group("/api/") },
+	}
+	for i, register := range invalid {
+		assert.Panics(t, register, "case %d", i)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, used to interrupt a pending read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader is the reader requests are parsed from. It remembers whether a
+// read hit the connection deadline, since handlers reading the body see that
+// only as an error.
+//
+// While a handler runs and the request body is used up, connReader keeps a
+// one byte read pending on the connection to notice the client going away.
+// A byte that arrives meanwhile belongs to the next request and is handed
+// out by the next Read.
+type connReader struct {
+	conn     net.Conn
+	timedOut bool
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	inRead  bool
+	aborted bool
+	hasByte bool
+	byteBuf [1]byte
+	// cancel is called when the background read finds the connection gone.
+	cancel context.CancelFunc
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	cr := &connReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	if cr.inRead {
+		cr.mu.Unlock()
+		panic("server: read on a connection with a pending background read")
+	}
+	if cr.hasByte && len(p) > 0 {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.mu.Unlock()
+		return 1, nil
+	}
+	cr.mu.Unlock()
+	n, err := cr.conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		cr.timedOut = true
+	}
+	return n, err
+}
+
+// startBackgroundRead starts watching the connection for the client closing
+// it, calling cancel when it does. The caller must not Read until
+// abortPendingRead returned.
+func (cr *connReader) startBackgroundRead(cancel context.CancelFunc) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inRead || cr.hasByte {
+		return
+	}
+	cr.inRead = true
+	cr.cancel = cancel
+	// The body is read, its deadline no longer applies.
+	cr.conn.SetReadDeadline(time.Time{})
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.conn.Read(cr.byteBuf[:])
+	cr.mu.Lock()
+	if n == 1 {
+		cr.hasByte = true
+	}
+	if err != nil && !(cr.aborted && errors.Is(err, os.ErrDeadlineExceeded)) {
+		cr.cancel()
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.mu.Unlock()
+	cr.cond.Broadcast()
+}
+
+// abortPendingRead stops the background read, if any, and waits for it to
+// return.
+func (cr *connReader) abortPendingRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.SetReadDeadline(time.Time{})
+}
+
+// observedBody remembers the last error the handler got from the request
+// body, so the server can answer with the status that error maps to.
+// It calls onEOF once the body was read to the end.
+type observedBody struct {
+	io.ReadCloser
+	err   error
+	onEOF func()
+}
+
+func (b *observedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	if err == io.EOF && b.onEOF != nil {
+		b.onEOF()
+		b.onEOF = nil
+	}
+	return n, err
+}
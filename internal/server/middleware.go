@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"httpFromTCP/internal/request"
+	"httpFromTCP/internal/response"
+	"log"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a Handler with behaviour that runs around it.
+type Middleware func(Handler) Handler
+
+// Chain composes middleware into one. The first middleware is the outermost,
+// so it sees the request first and the outcome last.
+func Chain(middleware ...Middleware) Middleware {
+	return func(handler Handler) Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			handler = middleware[i](handler)
+		}
+		return handler
+	}
+}
+
+// Logging logs every request with the status it was answered with, the body
+// bytes written and how long the handler took. A returned HandlerError is
+// logged with its code, since the server writes it after the chain returns.
+// The line starts with the request ID when RequestID runs before Logging.
+func Logging(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) *HandlerError {
+			start := time.Now()
+			handlerErr := next(w, req)
+			status := w.Status()
+			bytesWritten := w.BytesWritten()
+			if handlerErr != nil && !w.HeadersSent() {
+				status = handlerErr.Code
+				bytesWritten = int64(len(handlerErr.Message))
+			} else if status == 0 {
+				// The server answers 200 for a handler that wrote nothing.
+				status = response.STATUS_CODE_OK
+			}
+			if id := RequestIDFromContext(req.Context()); id != "" {
+				logger.Printf("%v %v %v %d %dB %v", id, req.RequestLine.Method, req.RequestLine.RequestTarget, status, bytesWritten, time.Since(start))
+			} else {
+				logger.Printf("%v %v %d %dB %v", req.RequestLine.Method, req.RequestLine.RequestTarget, status, bytesWritten, time.Since(start))
+			}
+			return handlerErr
+		}
+	}
+}
+
+// BasicAuth lets only requests with credentials accepted by valid through,
+// others are answered with a 401 challenge for realm.
+func BasicAuth(realm string, valid func(user, password string) bool) Middleware {
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) *HandlerError {
+			user, password, ok := basicAuth(req)
+			if ok && valid(user, password) {
+				return next(w, req)
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.Header().Set("Content-Type", "text/plain")
+			if err := w.WriteHeader(response.STATUS_CODE_UNAUTHORIZED); err != nil {
+				return &HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: err.Error()}
+			}
+			w.Write([]byte(response.StatusText(response.STATUS_CODE_UNAUTHORIZED)))
+			return nil
+		}
+	}
+}
+
+// basicAuth extracts the credentials of the Authorization header.
+func basicAuth(req *request.Request) (string, string, bool) {
+	authorization, ok := req.Headers.Get("Authorization")
+	if !ok {
+		return "", "", false
+	}
+	scheme, credentials, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// CheckCredentials compares credentials in constant time, for use as the
+// valid function of BasicAuth with a single user.
+func CheckCredentials(expectedUser, expectedPassword string) func(user, password string) bool {
+	return func(user, password string) bool {
+		userMatches := subtle.ConstantTimeCompare([]byte(user), []byte(expectedUser))
+		passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword))
+		return userMatches&passwordMatches == 1
+	}
+}
+
+// MapErrors passes every HandlerError returned by the handler through fn
+// before the server writes it, for instance to turn plain messages into
+// error pages. Returning nil from fn drops the error.
+func MapErrors(fn func(req *request.Request, handlerErr *HandlerError) *HandlerError) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) *HandlerError {
+			handlerErr := next(w, req)
+			if handlerErr == nil {
+				return nil
+			}
+			return fn(req, handlerErr)
+		}
+	}
+}
+
+// REQUEST_ID is the header a request ID is taken from and echoed in.
+const REQUEST_ID = "X-Request-Id"
+
+// maxRequestIDLength bounds the IDs accepted from clients, which end up in
+// logs.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID gives every request an ID, stored in its context and echoed in
+// the X-Request-Id response header. An ID sent by the client is kept when it
+// is short and printable, otherwise a random one is made up.
+func RequestID() Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) *HandlerError {
+			id, ok := req.Headers.Get(REQUEST_ID)
+			if !ok || !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(REQUEST_ID, id)
+			return next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+		}
+	}
+}
+
+// RequestIDFromContext returns the ID RequestID stored in ctx, or "" when
+// there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7F {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/tls"
+	"httpFromTCP/internal/request"
+	"time"
+)
+
+type Option func(*Server)
+
+// WithMaxConnections caps how many connections are served at the same time.
+// A value of zero or less means no limit.
+func WithMaxConnections(max int) Option {
+	return func(s *Server) {
+		s.maxConnections = max
+	}
+}
+
+// WithRejectWhenFull makes the server answer new connections with a 503
+// instead of making them wait while the connection limit is reached.
+func WithRejectWhenFull() Option {
+	return func(s *Server) {
+		s.rejectWhenFull = true
+	}
+}
+
+// WithHeaderReadTimeout bounds how long a client may take to send the request
+// line and headers, counted from the first byte of the request.
+func WithHeaderReadTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.headerReadTimeout = timeout
+	}
+}
+
+// WithBodyReadTimeout bounds how long reading the request body may take once
+// the headers have been received.
+func WithBodyReadTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.bodyReadTimeout = timeout
+	}
+}
+
+// WithWriteTimeout bounds how long the handler has to write its response.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = timeout
+	}
+}
+
+// WithHandlerTimeout cancels the context of a request once its handler has
+// run for timeout. Handlers that respect their context stop then.
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.handlerTimeout = timeout
+	}
+}
+
+// WithIdleTimeout bounds how long a keep-alive connection may wait for the
+// next request before the server closes it.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithLimits bounds the size of request lines, headers and bodies. Requests
+// over a limit are answered with 414, 431 or 413.
+func WithLimits(limits request.Limits) Option {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// WithTLSConfig sets the TLS configuration the TLS listeners start from, for
+// instance to require client certificates or restrict the TLS versions. The
+// certificates and ALPN protocol are added to a copy of config.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfigBase = config
+	}
+}
+
+// WithCertificate adds a certificate the TLS listeners serve to clients
+// asking for one of the names it is valid for. The first certificate is the
+// default for other clients. Certificates are reloaded when their files
+// change.
+func WithCertificate(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.certFiles = append(s.certFiles, [2]string{certFile, keyFile})
+	}
+}
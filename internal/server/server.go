@@ -1,13 +1,40 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"httpFromTCP/internal/headers"
 	"httpFromTCP/internal/request"
 	"httpFromTCP/internal/response"
+	"io"
 	"log"
 	"net"
+	"os"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
+)
+
+const serverFullMessage = "server is at its connection limit, try again later"
+const requestTimeoutMessage = "request was not received in time"
+const internalErrorMessage = "the server failed to produce a response"
+const shutdownPollInterval = 10 * time.Millisecond
+const minAcceptRetryDelay = 5 * time.Millisecond
+const maxAcceptRetryDelay = time.Second
+
+// rejectWriteTimeout bounds writing the 503 to a rejected connection when no
+// write timeout is configured. Rejected connections are not tracked, so
+// nothing else would close them.
+const rejectWriteTimeout = 5 * time.Second
+
+type connState int
+
+const (
+	connStateIdle connState = iota
+	connStateActive
 )
 
 type HandlerError struct {
@@ -17,52 +44,328 @@ type HandlerError struct {
 type Handler func(w *response.Writer, request *request.Request) *HandlerError
 
 type Server struct {
-	connections map[net.Conn]net.Conn
+	mu          sync.Mutex
+	connections map[net.Conn]connState
 	closed      atomic.Bool
-	listener    net.Listener
+	done        chan struct{}
+	listeners   []net.Listener
+	handler     Handler
+	// baseCtx is the parent of every request context, cancelled as soon as
+	// the server starts closing.
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+
+	// connSlots is a semaphore bounding the number of connections served at
+	// once. It is nil when no limit is configured.
+	connSlots      chan struct{}
+	maxConnections int
+	rejectWhenFull bool
+
+	// Timeouts are disabled when zero.
+	headerReadTimeout time.Duration
+	bodyReadTimeout   time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	handlerTimeout    time.Duration
+
+	limits request.Limits
+
+	// tlsConfigBase and certFiles configure the TLS listeners. tlsConf is
+	// built from them for the first one.
+	tlsConfigBase *tls.Config
+	certFiles     [][2]string
+	tlsConf       *tls.Config
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
-	server := Server{listener: listener, connections: make(map[net.Conn]net.Conn)}
-	go server.listen(handler)
-	return &server, err
+// ErrServerClosed is returned when adding a listener to a closed server.
+var ErrServerClosed = errors.New("server: server closed")
+
+// Serve answers requests on every interface at port with handler. It is
+// New followed by Listen.
+func Serve(port int, handler Handler, options ...Option) (*Server, error) {
+	server := New(handler, options...)
+	if err := server.Listen("tcp", fmt.Sprintf(":%v", port)); err != nil {
+		return nil, err
+	}
+	return server, nil
 }
 
-func (s *Server) Close() error {
-	if s.closed.Load() {
-		return fmt.Errorf("server: closing an already closed server.")
+// New creates a server answering requests with handler. It serves nothing
+// until listeners are added with Listen, ListenTLS, ServeListener or
+// ServeTLSListener, and it may serve several at once.
+func New(handler Handler, options ...Option) *Server {
+	server := &Server{handler: handler, connections: make(map[net.Conn]connState), done: make(chan struct{})}
+	server.baseCtx, server.cancelBase = context.WithCancel(context.Background())
+	for _, option := range options {
+		option(server)
 	}
-	err := s.listener.Close()
+	if server.maxConnections > 0 {
+		server.connSlots = make(chan struct{}, server.maxConnections)
+	}
+	return server
+}
+
+// Listen starts serving on a new listener for the network and address, as
+// accepted by net.Listen: "tcp" with "127.0.0.1:8080" or "[::1]:8080", or
+// "unix" with the path of a socket.
+func (s *Server) Listen(network, address string) error {
+	listener, err := net.Listen(network, address)
 	if err != nil {
-		s.closed.Store(true)
+		return err
+	}
+	return s.ServeListener(listener)
+}
+
+// ServeListener starts serving connections accepted from listener, which
+// the server closes when it is closed. It returns ErrServerClosed, closing
+// listener, when the server is already closed.
+func (s *Server) ServeListener(listener net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, listener)
+	go s.listen(listener)
+	return nil
+}
+
+// Addrs returns the addresses of the listeners, in the order they were
+// added.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, listener := range s.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
+}
+
+// closeListeners closes every listener and returns the first error.
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, listener := range s.listeners {
+		if closeErr := listener.Close(); err == nil {
+			err = closeErr
+		}
 	}
 	return err
 }
 
-func (s *Server) listen(handler Handler) {
+// Close stops accepting connections and immediately closes every open
+// connection, including those in the middle of a request.
+func (s *Server) Close() error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return fmt.Errorf("server: closing an already closed server.")
+	}
+	close(s.done)
+	s.cancelBase()
+	err := s.closeListeners()
+	s.closeConns(false)
+	return err
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to
+// finish, closing connections as soon as they become idle. When ctx expires
+// before that happens the remaining connections are closed forcefully and
+// the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return fmt.Errorf("server: shutting down an already closed server.")
+	}
+	close(s.done)
+	s.cancelBase()
+	err := s.closeListeners()
 
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
 	for {
-		if s.closed.Load() {
-			break
+		if s.closeConns(true) == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns(false)
+			return ctx.Err()
+		case <-ticker.C:
 		}
-		conn, err := s.listener.Accept()
+	}
+}
+
+// closeConns closes tracked connections, only the idle ones when idleOnly is
+// set, and returns how many connections are still open afterwards.
+func (s *Server) closeConns(idleOnly bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.connections {
+		if idleOnly && state != connStateIdle {
+			continue
+		}
+		conn.Close()
+		delete(s.connections, conn)
+	}
+	return len(s.connections)
+}
+
+// listen accepts connections from listener until it is closed. Temporary
+// errors, such as running out of file descriptors, are retried with a
+// growing delay. Any other error stops accepting from the listener.
+func (s *Server) listen(listener net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("ERROR: something went wrong while connection establishment", err)
+			if s.closed.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if !isTemporary(err) {
+				log.Printf("ERROR: accepting on %v failed, no longer listening: %v\n", listener.Addr(), err)
+				return
+			}
+			delay = min(max(2*delay, minAcceptRetryDelay), maxAcceptRetryDelay)
+			log.Printf("ERROR: accepting on %v failed, retrying in %v: %v\n", listener.Addr(), delay, err)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		delay = 0
+		acquired, shuttingDown := s.acquireSlot()
+		if shuttingDown {
+			conn.Close()
+			break
+		}
+		if !acquired {
+			go s.reject(conn)
+			continue
+		}
+		if !s.trackNewConn(conn) {
+			s.releaseSlot()
+			conn.Close()
+			break
 		}
-		s.handle(conn, handler)
+		go func() {
+			defer s.releaseSlot()
+			s.handle(conn, s.handler)
+		}()
 	}
 }
 
-func (h *HandlerError) writeToConn(w response.Writer) error {
-	res := h.Code
-	errHeaders := headers.GetDefaultHeaders(len(h.Message))
-	err := w.WriteStatusLine(res)
-	if err != nil {
-		log.Printf("ERROR: %v\n", h.Message)
+// isTemporary reports whether an Accept error may go away by itself.
+func isTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// acquireSlot reserves room for one more connection. When the server is full
+// it either blocks until a connection finishes or, if configured to reject,
+// reports false straight away. Waiting is abandoned when the server closes.
+func (s *Server) acquireSlot() (acquired bool, shuttingDown bool) {
+	if s.connSlots == nil {
+		return true, false
+	}
+	if !s.rejectWhenFull {
+		select {
+		case s.connSlots <- struct{}{}:
+			return true, false
+		case <-s.done:
+			return false, true
+		}
+	}
+	select {
+	case s.connSlots <- struct{}{}:
+		return true, false
+	default:
+		return false, false
+	}
+}
+
+func (s *Server) releaseSlot() {
+	if s.connSlots == nil {
+		return
+	}
+	<-s.connSlots
+}
+
+func (s *Server) reject(conn net.Conn) {
+	defer conn.Close()
+	timeout := s.writeTimeout
+	if timeout <= 0 {
+		timeout = rejectWriteTimeout
+	}
+	setDeadline(conn.SetWriteDeadline, timeout)
+	handlerErr := HandlerError{Code: response.STATUS_CODE_SERVICE_UNAVAILABLE, Message: serverFullMessage}
+	handlerErr.writeToConn(response.NewWriter(conn))
+}
+
+// setConnState records what a connection is doing so Shutdown knows which
+// connections it may close without cutting off a response. It reports false
+// when the connection was already closed by the server.
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == connStateActive {
+		if _, ok := s.connections[conn]; !ok {
+			return false
+		}
+	}
+	s.connections[conn] = state
+	return true
+}
+
+// trackNewConn starts tracking an accepted connection as idle, unless the
+// server has been closed in the meantime.
+func (s *Server) trackNewConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return false
+	}
+	s.connections[conn] = connStateIdle
+	return true
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.connections, conn)
+}
+
+// writeToConn answers with the error in place of whatever the handler left
+// unsent. It fails when the handler already sent its headers, in which case
+// the connection has to be closed. The request ID set by RequestID is kept.
+func (h *HandlerError) writeToConn(w *response.Writer) error {
+	id, hasID := w.Header().Get(REQUEST_ID)
+	if err := w.Reset(); err != nil {
+		log.Printf("ERROR: can't write %d after the headers were sent: %v\n", h.Code, h.Message)
+		return err
+	}
+	// Statuses such as 204 and 304 carry neither a body nor its length.
+	errHeaders := headers.NewHeaders()
+	var message []byte
+	if response.BodyAllowed(h.Code) {
+		errHeaders = headers.GetDefaultHeaders(len(h.Message))
+		message = []byte(h.Message)
+	}
+	if hasID {
+		errHeaders.Set(REQUEST_ID, id)
+	}
+	err := w.WriteStatusLine(h.Code)
+	if err == nil {
+		err = w.WriteHeaders(errHeaders)
+	}
+	if err == nil {
+		err = w.WriteBody(message)
+	}
+	if err == nil {
+		err = w.Finish()
 	}
-	err = w.WriteHeaders(errHeaders)
-	err = w.WriteBody([]byte(h.Message))
 	if err != nil {
 		log.Printf("ERROR: %v\n", h.Message)
 	}
@@ -71,18 +374,182 @@ func (h *HandlerError) writeToConn(w response.Writer) error {
 
 func (s *Server) handle(conn net.Conn, handler Handler) {
 	defer conn.Close()
-	s.connections[conn] = conn
+	defer s.forgetConn(conn)
 	log.Println("Handler acceped!")
-	req, err := request.RequestFromReader(conn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.handshake(tlsConn); err != nil {
+			log.Printf("TLS handshake with %v failed: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	cr := newConnReader(conn)
+	reader := request.NewReader(cr)
+	reader.Limits = s.limits
+	// The first request is due within the header timeout, later ones within
+	// the idle timeout.
+	setDeadline(conn.SetReadDeadline, s.headerReadTimeout)
+	for {
+		if reader.WaitForRequest() != nil {
+			return
+		}
+		// A request counts as in flight from its first byte on, so that
+		// Shutdown lets it finish even while its head is still arriving.
+		if !s.setConnState(conn, connStateActive) {
+			return
+		}
+		if !s.serveRequest(conn, cr, reader, handler) || s.closed.Load() {
+			return
+		}
+		s.setConnState(conn, connStateIdle)
+		setDeadline(conn.SetReadDeadline, s.idleTimeout)
+	}
+}
+
+// requestContext derives the context of a request from the server's, with
+// the handler timeout applied.
+func (s *Server) requestContext() (context.Context, context.CancelFunc) {
+	if s.handlerTimeout > 0 {
+		return context.WithTimeout(s.baseCtx, s.handlerTimeout)
+	}
+	return context.WithCancel(s.baseCtx)
+}
+
+// ErrAbortHandler can be passed to panic to stop a handler and drop the
+// connection without the panic being logged.
+var ErrAbortHandler = errors.New("server: abort handler")
+
+// callHandler calls handler and recovers from a panic in it, logging the
+// panic with its stack trace. It reports whether the handler panicked.
+func callHandler(handler Handler, w *response.Writer, req *request.Request) (handlerErr *HandlerError, panicked bool) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		panicked = true
+		if recovered != ErrAbortHandler {
+			log.Printf("PANIC serving %v %v: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, recovered, debug.Stack())
+		}
+	}()
+	return handler(w, req), false
+}
+
+// abortConn makes closing the connection reset it, so that a client reading a
+// body delimited by the connection close sees an error instead of what looks
+// like a complete response.
+func abortConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
+// setDeadline moves a connection deadline timeout into the future, or clears
+// it when timeout is zero.
+func setDeadline(set func(time.Time) error, timeout time.Duration) {
+	if timeout <= 0 {
+		set(time.Time{})
+		return
+	}
+	set(time.Now().Add(timeout))
+}
+
+// serveRequest reads and answers a single request from the connection. It
+// reports whether the connection can be reused for another request.
+func (s *Server) serveRequest(conn net.Conn, cr *connReader, reader *request.Reader, handler Handler) bool {
+	setDeadline(conn.SetReadDeadline, s.headerReadTimeout)
+	cr.timedOut = false
+	req, err := reader.ReadRequest()
+	if err == io.EOF || errors.Is(err, request.ErrUnreadBody) {
+		return false
+	}
+	setDeadline(conn.SetReadDeadline, s.bodyReadTimeout)
+	setDeadline(conn.SetWriteDeadline, s.writeTimeout)
 	responseWriter := response.NewWriter(conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		handlerErr := HandlerError{Code: response.STATUS_CODE_REQUEST_TIMEOUT, Message: requestTimeoutMessage}
+		handlerErr.writeToConn(responseWriter)
+		return false
+	}
 	if err != nil {
-		handlerErr := HandlerError{Code: 400, Message: err.Error()}
-		handlerErr.writeToConn(*responseWriter)
-		return
+		log.Printf("Bad request from %v: %v\n", conn.RemoteAddr(), err)
+		handlerErr := HandlerError{Code: response.StatusCode(request.StatusCode(err)), Message: request.Reason(err)}
+		handlerErr.writeToConn(responseWriter)
+		return false
+	}
+	responseWriter.SetVersion(req.RequestLine.HttpVersion)
+	responseWriter.SetKeepAlive(req.KeepAlive() && !s.closed.Load())
+	responseWriter.SetOmitBody(req.RequestLine.Method == "HEAD")
+	ctx, cancel := s.requestContext()
+	defer cancel()
+	req = req.WithContext(ctx)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+	// Once the body is used up the connection can be watched for the client
+	// hanging up, which cancels the context.
+	defer cr.abortPendingRead()
+	watch := func() { cr.startBackgroundRead(cancel) }
+	if req.Body == request.NoBody {
+		watch()
+	}
+	body := &observedBody{ReadCloser: req.Body, onEOF: watch}
+	req.Body = body
+	// The next request can only be read once the rest of this body has been
+	// skipped. When that is too much the connection has to be closed, which
+	// the headers have to announce.
+	handlerDone := false
+	responseWriter.SetBeforeHeaders(func() {
+		if handlerDone {
+			if reader.SkipBody() != nil {
+				responseWriter.SetKeepAlive(false)
+			}
+		} else if !reader.CanSkipBody() {
+			// The handler may still read the body, but can't be relied on
+			// to. The rest of a chunked body is of unknown size.
+			responseWriter.SetKeepAlive(false)
+		}
+	})
+	handlerErr, panicked := callHandler(handler, responseWriter, req)
+	handlerDone = true
+	req.Body.Close()
+	if panicked {
+		// The handler may have left the request body half read.
+		responseWriter.SetKeepAlive(false)
+		if responseWriter.HeadersSent() {
+			abortConn(conn)
+			return false
+		}
+		handlerErr = &HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: internalErrorMessage}
+	}
+	var limitErr *request.LimitError
+	if handlerErr != nil && errors.As(body.err, &limitErr) {
+		// The handler gave up because the body was over the limit.
+		responseWriter.SetKeepAlive(false)
+		handlerErr = &HandlerError{Code: response.StatusCode(limitErr.StatusCode()), Message: limitErr.Error()}
+	}
+	if cr.timedOut {
+		// The body did not arrive in time, so the rest of it can't be skipped.
+		responseWriter.SetKeepAlive(false)
+		if handlerErr != nil {
+			handlerErr = &HandlerError{Code: response.STATUS_CODE_REQUEST_TIMEOUT, Message: requestTimeoutMessage}
+		}
 	}
-	handlerErr := handler(responseWriter, &req)
 	if handlerErr != nil {
 		log.Println("Serve Errors: ", handlerErr)
-		handlerErr.writeToConn(*responseWriter)
+		if handlerErr.writeToConn(responseWriter) != nil {
+			return false
+		}
+	} else if err := responseWriter.Finish(); err != nil {
+		log.Printf("ERROR: incomplete response to %v: %v\n", conn.RemoteAddr(), err)
+		if !responseWriter.HeadersSent() {
+			handlerErr := HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: internalErrorMessage}
+			handlerErr.writeToConn(responseWriter)
+		}
+		return false
 	}
+	return responseWriter.KeepAlive() && !cr.timedOut
 }
@@ -0,0 +1,1196 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"httpFromTCP/internal/headers"
+	"httpFromTCP/internal/request"
+	"httpFromTCP/internal/response"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler Handler, options ...Option) *Server {
+	t.Helper()
+	s, err := Serve(0, handler, options...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dial(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func okHandler(w *response.Writer, _ *request.Request) *HandlerError {
+	w.WriteStatusLine(response.STATUS_CODE_OK)
+	w.WriteHeaders(headers.GetDefaultHeaders(0))
+	return nil
+}
+
+func readStatusLine(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return line
+}
+
+func TestSlowConnectionDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		return okHandler(w, req)
+	}
+	s := startServer(t, handler)
+
+	slow := dial(t, s)
+	_, err := slow.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	fast := dial(t, s)
+	_, err = fast.Write([]byte("GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", readStatusLine(t, fast))
+
+	close(release)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", readStatusLine(t, slow))
+}
+
+func TestRejectWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		<-release
+		return okHandler(w, req)
+	}
+	s := startServer(t, handler, WithMaxConnections(1), WithRejectWhenFull())
+
+	busy := dial(t, s)
+	_, err := busy.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	// Test: wait for the first connection to occupy the only slot
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.connections) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	rejected := dial(t, s)
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable\r\n", readStatusLine(t, rejected))
+
+	// Test: a client that never reads the 503 does not hold the connection
+	s = New(okHandler, WithWriteTimeout(50*time.Millisecond))
+	client, conn := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		s.reject(conn)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("rejecting a client that does not read did not give up")
+	}
+}
+
+func echoTargetHandler(w *response.Writer, req *request.Request) *HandlerError {
+	body := req.RequestLine.RequestTarget
+	w.WriteStatusLine(response.STATUS_CODE_OK)
+	w.WriteHeaders(headers.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+	return nil
+}
+
+func readResponse(t *testing.T, br *bufio.Reader) (*http.Response, string) {
+	t.Helper()
+	res, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestKeepAliveServesManyRequests(t *testing.T) {
+	s := startServer(t, echoTargetHandler)
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+
+	for _, target := range []string{"/one", "/two", "/three"} {
+		_, err := conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		res, body := readResponse(t, br)
+		assert.Equal(t, target, body)
+		assert.Equal(t, "keep-alive", res.Header.Get("Connection"))
+	}
+}
+
+func TestPipelinedRequestsAreAnsweredInOrder(t *testing.T) {
+	s := startServer(t, echoTargetHandler)
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+
+	_, err := conn.Write([]byte("POST /one HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc" +
+		"GET /two HTTP/1.1\r\n\r\n" +
+		"GET /three HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+
+	_, body := readResponse(t, br)
+	assert.Equal(t, "/one", body)
+	_, body = readResponse(t, br)
+	assert.Equal(t, "/two", body)
+	res, body := readResponse(t, br)
+	assert.Equal(t, "/three", body)
+	assert.True(t, res.Close)
+
+	// Test: the server closes the connection after "Connection: close"
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHTTP10ClosesByDefault(t *testing.T) {
+	s := startServer(t, echoTargetHandler)
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+
+	_, err := conn.Write([]byte("GET /old HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	res, body := readResponse(t, br)
+	assert.Equal(t, "/old", body)
+	assert.Equal(t, "HTTP/1.0", res.Proto)
+	assert.True(t, res.Close)
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/slow" {
+			close(started)
+			<-release
+		}
+		return echoTargetHandler(w, req)
+	}
+	s := startServer(t, handler)
+
+	idle := dial(t, s)
+	idleReader := bufio.NewReader(idle)
+	_, err := idle.Write([]byte("GET /idle HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	readResponse(t, idleReader)
+
+	busy := dial(t, s)
+	_, err = busy.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+
+	// Test: idle keep-alive connections are closed right away
+	_, err = idleReader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: the in-flight request still gets its full response
+	close(release)
+	busyReader := bufio.NewReader(busy)
+	_, body := readResponse(t, busyReader)
+	assert.Equal(t, "/slow", body)
+	require.NoError(t, <-shutdownErr)
+	_, err = busyReader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: no new connections are accepted
+	_, err = net.Dial("tcp", s.Addrs()[0].String())
+	assert.Error(t, err)
+}
+
+func TestShutdownWaitsForPartlyReceivedRequest(t *testing.T) {
+	s := startServer(t, echoTargetHandler)
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: x\r\n"))
+	require.NoError(t, err)
+	// Give the server time to read the first part of the head.
+	time.Sleep(50 * time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Test: the request is answered once the rest of it arrives
+	_, err = conn.Write([]byte("Content-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	res, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "/upload", body)
+	require.NoError(t, <-shutdownErr)
+}
+
+func TestShutdownForceClosesWhenContextExpires(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		close(started)
+		<-release
+		return okHandler(w, req)
+	}
+	s := startServer(t, handler)
+
+	busy := dial(t, s)
+	_, err := busy.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = busy.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHeaderReadTimeoutAnswers408(t *testing.T) {
+	s := startServer(t, okHandler, WithHeaderReadTimeout(50*time.Millisecond))
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: loc"))
+	require.NoError(t, err)
+	res, _ := readResponse(t, br)
+	assert.Equal(t, http.StatusRequestTimeout, res.StatusCode)
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestBodyReadTimeoutAnswers408(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		_, err := io.ReadAll(req.Body)
+		if err != nil {
+			return &HandlerError{Code: response.STATUS_CODE_BAD_REQUEST, Message: err.Error()}
+		}
+		return okHandler(w, req)
+	}
+	s := startServer(t, handler, WithBodyReadTimeout(50*time.Millisecond))
+	conn := dial(t, s)
+
+	_, err := conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	res, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, http.StatusRequestTimeout, res.StatusCode)
+}
+
+func TestIdleTimeoutClosesKeepAliveConnection(t *testing.T) {
+	s := startServer(t, echoTargetHandler, WithIdleTimeout(50*time.Millisecond))
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+
+	_, err := conn.Write([]byte("GET /first HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	_, body := readResponse(t, br)
+	assert.Equal(t, "/first", body)
+
+	// Test: an idle connection is closed without a response
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLargeUploadIsStreamedToHandler(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		n, err := io.Copy(io.Discard, req.Body)
+		if err != nil {
+			return &HandlerError{Code: response.STATUS_CODE_BAD_REQUEST, Message: err.Error()}
+		}
+		body := strconv.FormatInt(n, 10)
+		w.WriteStatusLine(response.STATUS_CODE_OK)
+		w.WriteHeaders(headers.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+		return nil
+	}
+	s := startServer(t, handler)
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+
+	const size = 4 << 20
+	go func() {
+		conn.Write([]byte("POST /upload HTTP/1.1\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n"))
+		conn.Write(bytes.Repeat([]byte("x"), size))
+	}()
+	_, body := readResponse(t, br)
+	assert.Equal(t, strconv.Itoa(size), body)
+}
+
+func TestUnreadBodyDecidesKeepAlive(t *testing.T) {
+	// The response is buffered, so its headers are only sent once the
+	// handler returned.
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		w.Write([]byte(req.RequestLine.RequestTarget))
+		return nil
+	}
+	s := startServer(t, handler)
+
+	// Test: small unread bodies are skipped to reach the next request
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+	_, err := conn.Write([]byte("POST /a HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST /b HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n" +
+		"GET /c HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	for _, target := range []string{"/a", "/b", "/c"} {
+		res, body := readResponse(t, br)
+		assert.False(t, res.Close, target)
+		assert.Equal(t, target, body)
+	}
+
+	// Test: a body too large to be skipped closes the connection, which the
+	// response announces
+	conn = dial(t, s)
+	br = bufio.NewReader(conn)
+	go func() {
+		conn.Write([]byte("POST /a HTTP/1.1\r\nContent-Length: 1048576\r\n\r\n"))
+		conn.Write(make([]byte, 1<<20))
+		conn.Write([]byte("GET /b HTTP/1.1\r\n\r\n"))
+	}()
+	res, body := readResponse(t, br)
+	assert.True(t, res.Close)
+	assert.Equal(t, "/a", body)
+
+	// Test: so does a body left unread when the headers are sent while the
+	// handler is still running
+	s = startServer(t, echoTargetHandler)
+	conn = dial(t, s)
+	br = bufio.NewReader(conn)
+	go func() {
+		conn.Write([]byte("POST /a HTTP/1.1\r\nContent-Length: 1048576\r\n\r\n"))
+		conn.Write(make([]byte, 1<<20))
+	}()
+	res, _ = readResponse(t, br)
+	assert.True(t, res.Close)
+}
+
+func TestLimitsMapToStatusCodes(t *testing.T) {
+	bodyReader := func(w *response.Writer, req *request.Request) *HandlerError {
+		_, err := io.ReadAll(req.Body)
+		if err != nil {
+			return &HandlerError{Code: response.STATUS_CODE_BAD_REQUEST, Message: err.Error()}
+		}
+		return okHandler(w, req)
+	}
+	limits := request.Limits{MaxRequestLineBytes: 64, MaxHeaderCount: 2, MaxHeaderBytes: 128, MaxBodyBytes: 8}
+	s := startServer(t, bodyReader, WithLimits(limits))
+
+	cases := map[string]struct {
+		request string
+		status  int
+	}{
+		"long target":        {"GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", http.StatusRequestURITooLong},
+		"many headers":       {"GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		"large header":       {"GET / HTTP/1.1\r\nCookie: " + strings.Repeat("c", 200) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		"declared body":      {"POST / HTTP/1.1\r\nContent-Length: 20\r\n\r\n", http.StatusRequestEntityTooLarge},
+		"large chunked body": {"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n10\r\n0123456789abcdef\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge},
+		"within limits":      {"POST / HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc", http.StatusOK},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			conn := dial(t, s)
+			_, err := conn.Write([]byte(c.request))
+			require.NoError(t, err)
+			res, _ := readResponse(t, bufio.NewReader(conn))
+			assert.Equal(t, c.status, res.StatusCode)
+		})
+	}
+}
+
+func TestParseErrorsMapToStatusCodes(t *testing.T) {
+	s := startServer(t, okHandler)
+
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/2.0\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, http.StatusHTTPVersionNotSupported, res.StatusCode)
+
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\n"))
+	require.NoError(t, err)
+	res, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, request.ErrInvalidContentLength.Error(), body)
+}
+
+func TestResponsesAreFramedAutomatically(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.STATUS_CODE_OK)
+		w.WriteHeaders(headers.NewHeaders())
+		if req.RequestLine.RequestTarget == "/large" {
+			w.Write(bytes.Repeat([]byte("x"), response.BODY_BUFFER_SIZE+1))
+			return nil
+		}
+		w.Write([]byte("hello "))
+		w.Write([]byte("world"))
+		return nil
+	})
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+
+	_, err := conn.Write([]byte("GET /small HTTP/1.1\r\nHost: localhost\r\n\r\nGET /large HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, body := readResponse(t, br)
+	assert.Equal(t, int64(11), res.ContentLength)
+	assert.Equal(t, "hello world", body)
+	res, body = readResponse(t, br)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Len(t, body, response.BODY_BUFFER_SIZE+1)
+	assert.Equal(t, "keep-alive", res.Header.Get("Connection"))
+}
+
+func TestHandlerErrorAfterHeadersClosesConnection(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, _ *request.Request) *HandlerError {
+		w.WriteStatusLine(response.STATUS_CODE_OK)
+		w.WriteHeaders(headers.GetDefaultHeaders(10))
+		w.Write([]byte("part"))
+		return &HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: "too late"}
+	})
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestHandlerErrorWithoutBody(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		code, _ := strconv.Atoi(strings.TrimPrefix(req.RequestLine.RequestTarget, "/"))
+		return &HandlerError{Code: response.StatusCode(code), Message: "x"}
+	}
+	s := startServer(t, handler)
+	conn := dial(t, s)
+	br := bufio.NewReader(conn)
+
+	// Test: statuses without a body are sent with neither body nor length,
+	// and the connection stays usable
+	for _, code := range []string{"204", "304"} {
+		_, err := conn.Write([]byte("GET /" + code + " HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+		head := ""
+		for !strings.HasSuffix(head, "\r\n\r\n") {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			head += line
+		}
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 "+code+" "), head)
+		assert.NotContains(t, head, "content-length")
+	}
+	_, err := conn.Write([]byte("GET /404 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	res, body := readResponse(t, br)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "x", body)
+}
+
+func TestInjectedResponseHeaderAnswers500(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.Header().Set("X-Echo", req.RequestLine.RequestTarget+"\r\nSet-Cookie: admin=1")
+		w.Write([]byte("hello"))
+		return nil
+	})
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Empty(t, res.Header.Values("Set-Cookie"))
+	assert.Empty(t, res.Header.Get("X-Echo"))
+}
+
+// runHandler runs handler on a parsed request without a connection and
+// returns the writer it wrote to.
+func runHandler(t *testing.T, handler Handler, rawRequest string) (*response.Writer, *HandlerError) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+	w := response.NewWriter(&bytes.Buffer{})
+	return w, handler(w, req)
+}
+
+func TestChainRunsMiddlewareInOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) *HandlerError {
+				calls = append(calls, name+" in")
+				handlerErr := next(w, req)
+				calls = append(calls, name+" out")
+				return handlerErr
+			}
+		}
+	}
+	handler := Chain(trace("outer"), trace("inner"))(func(w *response.Writer, req *request.Request) *HandlerError {
+		calls = append(calls, "handler")
+		return nil
+	})
+	runHandler(t, handler, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, []string{"outer in", "inner in", "handler", "inner out", "outer out"}, calls)
+}
+
+func TestLoggingRecordsStatusAndBytes(t *testing.T) {
+	logs := &bytes.Buffer{}
+	logging := Logging(log.New(logs, "", 0))
+
+	handler := logging(func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteHeader(response.STATUS_CODE_CREATED)
+		w.Write([]byte("hello"))
+		return nil
+	})
+	w, _ := runHandler(t, handler, "POST /items?x=1 HTTP/1.1\r\n\r\n")
+	assert.Equal(t, response.STATUS_CODE_CREATED, w.Status())
+	assert.Equal(t, int64(5), w.BytesWritten())
+	assert.True(t, strings.HasPrefix(logs.String(), "POST /items?x=1 201 5B "), logs.String())
+
+	logs.Reset()
+	handler = logging(func(w *response.Writer, req *request.Request) *HandlerError {
+		return &HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: "missing"}
+	})
+	runHandler(t, handler, "GET /gone HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(logs.String(), "GET /gone 404 7B "), logs.String())
+}
+
+func TestBasicAuth(t *testing.T) {
+	handler := BasicAuth("admin area", CheckCredentials("alice", "s3cret"))(okHandler)
+
+	// Test: no or wrong credentials get a challenge
+	for _, authorization := range []string{"", "Authorization: Basic YWxpY2U6d3Jvbmc=\r\n", "Authorization: Bearer token\r\n"} {
+		w, handlerErr := runHandler(t, handler, "GET / HTTP/1.1\r\n"+authorization+"\r\n")
+		require.Nil(t, handlerErr)
+		assert.Equal(t, response.STATUS_CODE_UNAUTHORIZED, w.Status())
+		challenge, _ := w.Header().Get("WWW-Authenticate")
+		assert.Equal(t, `Basic realm="admin area", charset="UTF-8"`, challenge)
+	}
+
+	// Test: alice:s3cret gets through
+	w, handlerErr := runHandler(t, handler, "GET / HTTP/1.1\r\nAuthorization: basic YWxpY2U6czNjcmV0\r\n\r\n")
+	require.Nil(t, handlerErr)
+	assert.Equal(t, response.STATUS_CODE_OK, w.Status())
+}
+
+func TestMapErrors(t *testing.T) {
+	handler := MapErrors(func(req *request.Request, handlerErr *HandlerError) *HandlerError {
+		return &HandlerError{Code: handlerErr.Code, Message: "<h1>" + handlerErr.Message + "</h1>"}
+	})(func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.URL.Path == "/fail" {
+			return &HandlerError{Code: response.STATUS_CODE_BAD_REQUEST, Message: "bad"}
+		}
+		return nil
+	})
+	_, handlerErr := runHandler(t, handler, "GET /fail HTTP/1.1\r\n\r\n")
+	require.NotNil(t, handlerErr)
+	assert.Equal(t, response.STATUS_CODE_BAD_REQUEST, handlerErr.Code)
+	assert.Equal(t, "<h1>bad</h1>", handlerErr.Message)
+
+	_, handlerErr = runHandler(t, handler, "GET /ok HTTP/1.1\r\n\r\n")
+	assert.Nil(t, handlerErr)
+}
+
+func TestPanicBeforeHeadersAnswers500(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.URL.Path == "/panic" {
+			w.Header().Set("X-Partial", "yes")
+			w.Write([]byte("buffered, never sent"))
+			panic("handler bug")
+		}
+		return okHandler(w, req)
+	})
+
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	res, body := readResponse(t, br)
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Empty(t, res.Header.Get("X-Partial"))
+	assert.NotContains(t, body, "buffered")
+	assert.True(t, res.Close)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: the server keeps serving other connections
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestPanicAfterHeadersAbortsConnection(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.Write(bytes.Repeat([]byte("x"), response.BODY_BUFFER_SIZE+1))
+		panic(ErrAbortHandler)
+	})
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	_, err = io.ReadAll(res.Body)
+	assert.Error(t, err)
+}
+
+// waitForCancel is a handler reporting the error its context ends with. It
+// reads the body first, since only then the connection can be watched.
+func waitForCancel(started chan<- struct{}, cause chan<- error) Handler {
+	return func(w *response.Writer, req *request.Request) *HandlerError {
+		io.ReadAll(req.Body)
+		close(started)
+		select {
+		case <-req.Context().Done():
+			cause <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			cause <- nil
+		}
+		return okHandler(w, req)
+	}
+}
+
+func TestContextCancelledWhenClientDisconnects(t *testing.T) {
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	s := startServer(t, waitForCancel(started, cause))
+
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	<-started
+	conn.Close()
+	assert.ErrorIs(t, <-cause, context.Canceled)
+}
+
+func TestContextSurvivesPipelinedRequest(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/first" {
+			close(started)
+			<-release
+			if req.Context().Err() != nil {
+				return &HandlerError{Code: response.STATUS_CODE_INTERNAL_SERVER_ERROR, Message: "cancelled"}
+			}
+		}
+		return echoTargetHandler(w, req)
+	}
+	s := startServer(t, handler)
+
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET /first HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	// Test: the next request arriving early neither cancels the running one
+	// nor gets lost
+	_, err = conn.Write([]byte("GET /second HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	br := bufio.NewReader(conn)
+	_, body := readResponse(t, br)
+	assert.Equal(t, "/first", body)
+	_, body = readResponse(t, br)
+	assert.Equal(t, "/second", body)
+}
+
+func TestContextCancelledOnShutdown(t *testing.T) {
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	s := startServer(t, waitForCancel(started, cause))
+
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	assert.ErrorIs(t, <-cause, context.Canceled)
+
+	// Test: the handler still gets to answer
+	res, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, res.StatusCode)
+	require.NoError(t, <-shutdownErr)
+}
+
+func TestHandlerTimeoutCancelsContext(t *testing.T) {
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	s := startServer(t, waitForCancel(started, cause), WithHandlerTimeout(50*time.Millisecond))
+
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	assert.ErrorIs(t, <-cause, context.DeadlineExceeded)
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID()(func(w *response.Writer, req *request.Request) *HandlerError {
+		seen = RequestIDFromContext(req.Context())
+		return nil
+	})
+
+	// Test: a sane ID from the client is kept
+	w, _ := runHandler(t, handler, "GET / HTTP/1.1\r\nX-Request-Id: abc-123\r\n\r\n")
+	assert.Equal(t, "abc-123", seen)
+	id, _ := w.Header().Get(REQUEST_ID)
+	assert.Equal(t, "abc-123", id)
+
+	// Test: a missing or unreasonable ID is replaced
+	for _, header := range []string{"", "X-Request-Id: " + strings.Repeat("x", 200) + "\r\n"} {
+		w, _ = runHandler(t, handler, "GET / HTTP/1.1\r\n"+header+"\r\n")
+		assert.Len(t, seen, 32)
+		id, _ = w.Header().Get(REQUEST_ID)
+		assert.Equal(t, seen, id)
+	}
+
+	// Test: error responses written by the server keep the ID
+	s := startServer(t, RequestID()(func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		return &HandlerError{Code: response.STATUS_CODE_NOT_FOUND, Message: "missing"}
+	}))
+	for _, target := range []string{"/missing", "/panic"} {
+		conn := dial(t, s)
+		_, err := conn.Write([]byte("GET " + target + " HTTP/1.1\r\nX-Request-Id: err-1\r\n\r\n"))
+		require.NoError(t, err)
+		res, _ := readResponse(t, bufio.NewReader(conn))
+		assert.GreaterOrEqual(t, res.StatusCode, 400, target)
+		assert.Equal(t, "err-1", res.Header.Get(REQUEST_ID), target)
+	}
+
+	// Test: Logging prefixes its line with the ID
+	logs := &bytes.Buffer{}
+	handler = Chain(RequestID(), Logging(log.New(logs, "", 0)))(okHandler)
+	runHandler(t, handler, "GET /x HTTP/1.1\r\nX-Request-Id: r1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(logs.String(), "r1 GET /x 200 "), logs.String())
+}
+
+// testCertificate is a certificate made up for a test, signed by parent or
+// self-signed when parent is nil.
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certPEM  []byte
+	keyPEM   []byte
+	keyPair  tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+func newTestCertificate(t *testing.T, commonName string, serial int64, parent *testCertificate, dnsNames ...string) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	c := &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	c.keyPair, err = tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	c.certFile, c.keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.writeTo(t, c.certFile, c.keyFile)
+	return c
+}
+
+func (c *testCertificate) writeTo(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(certFile, c.certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, c.keyPEM, 0o600))
+}
+
+func (c *testCertificate) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+func startTLSServer(t *testing.T, handler Handler, certFile, keyFile string, options ...Option) *Server {
+	t.Helper()
+	s, err := ServeTLS(0, handler, certFile, keyFile, options...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialTLS(t *testing.T, s *Server, config *tls.Config) *tls.Conn {
+	t.Helper()
+	conn, err := tls.Dial("tcp", s.Addrs()[0].String(), config)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// tlsStateHandler answers with what it sees of the TLS connection.
+func tlsStateHandler(w *response.Writer, req *request.Request) *HandlerError {
+	if req.TLS == nil {
+		w.Write([]byte("plaintext"))
+		return nil
+	}
+	peer := "-"
+	if len(req.TLS.PeerCertificates) > 0 {
+		peer = req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	w.Write([]byte(tls.VersionName(req.TLS.Version) + " " + req.TLS.ServerName + " " + req.TLS.NegotiatedProtocol + " " + peer))
+	return nil
+}
+
+func TestServeTLS(t *testing.T) {
+	cert := newTestCertificate(t, "localhost", 1, nil, "localhost")
+	s := startTLSServer(t, tlsStateHandler, cert.certFile, cert.keyFile)
+
+	conn := dialTLS(t, s, &tls.Config{RootCAs: cert.pool(), ServerName: "localhost", NextProtos: []string{"h2", "http/1.1"}})
+	// Test: ALPN picks HTTP/1.1 even when the client prefers h2
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+
+	br := bufio.NewReader(conn)
+	for range 2 {
+		_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		res, body := readResponse(t, br)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "TLS 1.3 localhost http/1.1 -", body)
+	}
+
+	// Test: plaintext clients are not served
+	plain := dial(t, s)
+	plain.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, err := io.ReadAll(plain)
+	require.NoError(t, err)
+}
+
+func TestServeTLSFailsWithoutCertificate(t *testing.T) {
+	_, err := ServeTLS(0, okHandler, "", "")
+	assert.Error(t, err)
+	_, err = ServeTLS(0, okHandler, filepath.Join(t.TempDir(), "missing.pem"), filepath.Join(t.TempDir(), "missing.key"))
+	assert.Error(t, err)
+}
+
+func TestServeTLSSelectsCertificateByServerName(t *testing.T) {
+	a := newTestCertificate(t, "a", 1, nil, "a.example")
+	b := newTestCertificate(t, "b", 2, nil, "b.example")
+	s := startTLSServer(t, okHandler, a.certFile, a.keyFile, WithCertificate(b.certFile, b.keyFile))
+
+	roots := a.pool()
+	roots.AddCert(b.cert)
+	for _, name := range []string{"a.example", "b.example"} {
+		conn := dialTLS(t, s, &tls.Config{RootCAs: roots, ServerName: name})
+		assert.Equal(t, []string{name}, conn.ConnectionState().PeerCertificates[0].DNSNames)
+	}
+
+	// Test: an unknown name gets the default certificate
+	conn := dialTLS(t, s, &tls.Config{InsecureSkipVerify: true, ServerName: "c.example"})
+	assert.Equal(t, "a", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
+
+func TestServeTLSReloadsChangedCertificate(t *testing.T) {
+	old := newTestCertificate(t, "localhost", 1, nil, "localhost")
+	renewed := newTestCertificate(t, "localhost", 2, nil, "localhost")
+	s := startTLSServer(t, okHandler, old.certFile, old.keyFile)
+	config := &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"}
+
+	conn := dialTLS(t, s, config)
+	assert.Equal(t, int64(1), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+
+	renewed.writeTo(t, old.certFile, old.keyFile)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(old.certFile, later, later))
+	conn = dialTLS(t, s, config)
+	assert.Equal(t, int64(2), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+}
+
+func TestServeTLSWithClientCertificates(t *testing.T) {
+	ca := newTestCertificate(t, "test CA", 1, nil)
+	serverCert := newTestCertificate(t, "localhost", 2, ca, "localhost")
+	clientCert := newTestCertificate(t, "alice", 3, ca)
+	s := startTLSServer(t, tlsStateHandler, "", "", WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert.keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+	}))
+
+	conn := dialTLS(t, s, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", Certificates: []tls.Certificate{clientCert.keyPair}, NextProtos: []string{"http/1.1"}})
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "TLS 1.2 localhost http/1.1 alice", body)
+
+	// Test: clients without a certificate are turned away
+	conn, err = tls.Dial("tcp", s.Addrs()[0].String(), &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"})
+	if err == nil {
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+	}
+	assert.Error(t, err)
+}
+
+func TestListenOnSeveralListeners(t *testing.T) {
+	s := New(echoTargetHandler)
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.Listen("tcp", "127.0.0.1:0"))
+	socket := filepath.Join(t.TempDir(), "server.sock")
+	require.NoError(t, s.Listen("unix", socket))
+	external, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, s.ServeListener(external))
+	if ipv6, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		require.NoError(t, s.ServeListener(ipv6))
+	} else {
+		t.Log("IPv6 loopback is not available:", err)
+	}
+
+	addrs := s.Addrs()
+	assert.Equal(t, external.Addr(), addrs[2])
+	for _, addr := range addrs {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("GET /" + addr.Network() + " HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+		_, body := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, "/"+addr.Network(), body)
+	}
+
+	// Test: closing the server closes every listener, including the one
+	// passed in
+	require.NoError(t, s.Close())
+	for _, addr := range addrs {
+		_, err := net.Dial(addr.Network(), addr.String())
+		assert.Error(t, err, addr.String())
+	}
+	_, err = os.Stat(socket)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: a closed server takes no new listeners
+	late, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.ErrorIs(t, s.ServeListener(late), ErrServerClosed)
+	_, err = late.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestServeTLSListener(t *testing.T) {
+	cert := newTestCertificate(t, "localhost", 1, nil, "localhost")
+	s := New(tlsStateHandler, WithCertificate(cert.certFile, cert.keyFile))
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.Listen("tcp", "127.0.0.1:0"))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, s.ServeTLSListener(listener))
+
+	// Test: plaintext and TLS listeners are served side by side
+	plain := dial(t, s)
+	_, err = plain.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	_, body := readResponse(t, bufio.NewReader(plain))
+	assert.Equal(t, "plaintext", body)
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: cert.pool(), ServerName: "localhost"})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	_, body = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "TLS 1.3 localhost  -", body)
+}
+
+func TestServeFailsCleanlyWhenPortIsTaken(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer taken.Close()
+	s, err := Serve(taken.Addr().(*net.TCPAddr).Port, okHandler)
+	assert.Error(t, err)
+	assert.Nil(t, s)
+}
+
+// temporaryError is an Accept error that goes away by itself.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+// scriptedListener hands out the results queued in accepts, and reports
+// itself closed once they run out.
+type scriptedListener struct {
+	accepts chan any
+	closed  chan struct{}
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	select {
+	case next := <-l.accepts:
+		if err, ok := next.(error); ok {
+			return nil, err
+		}
+		return next.(net.Conn), nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *scriptedListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// captureLogs sends the standard logger to a buffer for the rest of the test.
+func captureLogs(t *testing.T) *syncBuffer {
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return logs
+}
+
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func TestAcceptLoopRetriesTemporaryErrors(t *testing.T) {
+	logs := captureLogs(t)
+	listener := &scriptedListener{accepts: make(chan any), closed: make(chan struct{})}
+	s := New(echoTargetHandler)
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.ServeListener(listener))
+
+	for range 3 {
+		listener.accepts <- temporaryError{}
+	}
+	// Test: a connection accepted after the errors is served
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	listener.accepts <- server
+	_, err := client.Write([]byte("GET /after HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	_, body := readResponse(t, bufio.NewReader(client))
+	assert.Equal(t, "/after", body)
+	assert.Equal(t, 3, strings.Count(logs.String(), "retrying"), logs.String())
+}
+
+func TestAcceptLoopStopsQuietly(t *testing.T) {
+	logs := captureLogs(t)
+
+	// Test: a listener closed behind the server's back ends its loop
+	listener := &scriptedListener{accepts: make(chan any), closed: make(chan struct{})}
+	s := New(okHandler)
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.ServeListener(listener))
+	listener.Close()
+	select {
+	case listener.accepts <- temporaryError{}:
+		t.Fatal("the accept loop kept running after the listener was closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: a permanent error ends the loop with a single log line
+	listener = &scriptedListener{accepts: make(chan any), closed: make(chan struct{})}
+	require.NoError(t, s.ServeListener(listener))
+	listener.accepts <- errors.New("listener is broken")
+	select {
+	case listener.accepts <- temporaryError{}:
+		t.Fatal("the accept loop kept running after a permanent error")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 1, strings.Count(logs.String(), "ERROR"), logs.String())
+
+	// Test: closing the server stops the loops without logging
+	s = startServer(t, okHandler)
+	logsBefore := logs.String()
+	require.NoError(t, s.Close())
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, logsBefore, logs.String())
+}
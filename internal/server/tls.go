@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ALPN_HTTP1 is the ALPN protocol ID of HTTP/1.1, the only protocol the
+// server speaks.
+const ALPN_HTTP1 = "http/1.1"
+
+// certificate is a certificate loaded from a pair of PEM files. It is loaded
+// again when either file changes, so renewed certificates are picked up
+// without restarting the server.
+type certificate struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime returns the modification time of whichever file changed last.
+func (c *certificate) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+func (c *certificate) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("server: loading certificate %v: %w", c.certFile, err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// get returns the certificate, reloading it first when the files changed.
+// A certificate that fails to reload, for instance because only one of the
+// files was replaced so far, is logged and the previous one kept.
+func (c *certificate) get() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modTime, err := c.latestModTime()
+	if err == nil && !modTime.Equal(c.modTime) {
+		err = c.load(modTime)
+	}
+	if err != nil {
+		log.Println("ERROR: keeping the previous certificate:", err)
+	}
+	return c.cert
+}
+
+// tlsConfig returns the configuration TLS listeners use, building it on the
+// first call. It serves the certificates loaded from files, picking the one
+// matching the name the client asked for, and advertises HTTP/1.1 over ALPN.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tlsConf != nil {
+		return s.tlsConf, nil
+	}
+	certs := make([]*certificate, 0, len(s.certFiles))
+	for _, files := range s.certFiles {
+		cert, err := loadCertificate(files[0], files[1])
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	config := &tls.Config{}
+	if s.tlsConfigBase != nil {
+		config = s.tlsConfigBase.Clone()
+	}
+	if !slices.Contains(config.NextProtos, ALPN_HTTP1) {
+		config.NextProtos = append(config.NextProtos, ALPN_HTTP1)
+	}
+	if len(certs) > 0 {
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return selectCertificate(hello, certs), nil
+		}
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("server: TLS needs a certificate")
+	}
+	s.tlsConf = config
+	return config, nil
+}
+
+// selectCertificate returns the first certificate valid for the server name
+// and the capabilities of the client, or the first one when none is.
+func selectCertificate(hello *tls.ClientHelloInfo, certs []*certificate) *tls.Certificate {
+	for _, c := range certs {
+		cert := c.get()
+		if hello.SupportsCertificate(cert) == nil {
+			return cert
+		}
+	}
+	return certs[0].get()
+}
+
+// ServeTLS is Serve over TLS. The certificate is loaded from a PEM encoded
+// certificate chain and private key, and reloaded when the files change.
+// Additional certificates for other server names are added with
+// WithCertificate. certFile and keyFile may be empty when the configuration
+// given with WithTLSConfig brings its own certificates.
+func ServeTLS(port int, handler Handler, certFile, keyFile string, options ...Option) (*Server, error) {
+	if certFile != "" || keyFile != "" {
+		// The certificate given here is the default one, so it comes first.
+		options = append([]Option{WithCertificate(certFile, keyFile)}, options...)
+	}
+	server := New(handler, options...)
+	if err := server.ListenTLS("tcp", fmt.Sprintf(":%v", port)); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// ListenTLS is Listen over TLS, with the certificates and configuration set
+// by WithCertificate and WithTLSConfig.
+func (s *Server) ListenTLS(network, address string) error {
+	config, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.ServeListener(tls.NewListener(listener, config))
+}
+
+// ServeTLSListener is ServeListener over TLS, with the certificates and
+// configuration set by WithCertificate and WithTLSConfig.
+func (s *Server) ServeTLSListener(listener net.Listener) error {
+	config, err := s.tlsConfig()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	return s.ServeListener(tls.NewListener(listener, config))
+}
+
+// handshake completes the TLS handshake of a connection before its first
+// request is read, so handlers always see the connection state. The header
+// read timeout bounds the handshake too.
+func (s *Server) handshake(conn *tls.Conn) error {
+	setDeadline(conn.SetDeadline, s.headerReadTimeout)
+	if err := conn.HandshakeContext(s.baseCtx); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}